@@ -0,0 +1,65 @@
+package megapool
+
+import (
+	"net/netip"
+	"slices"
+	"sort"
+	"sync"
+)
+
+// Allocator hands out the addresses of a pool one at a time. It is safe for
+// concurrent use.
+type Allocator struct {
+	mu   sync.Mutex
+	pool []Range
+	free []Range
+}
+
+// NewAllocator returns an allocator over the addresses of m, all of them free.
+// Later changes to m are not seen by the allocator.
+func NewAllocator(m Megapool) *Allocator {
+	ivs := m.intervals()
+	return &Allocator{pool: ivs, free: slices.Clone(ivs)}
+}
+
+// Allocate marks the lowest free address as used and returns it. It returns
+// false once every address is in use.
+func (a *Allocator) Allocate() (netip.Addr, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.free) == 0 {
+		return netip.Addr{}, false
+	}
+	addr := a.free[0].From
+	if addr == a.free[0].To {
+		a.free = a.free[1:]
+	} else {
+		a.free[0].From = addr.Next()
+	}
+	return addr, true
+}
+
+// Release marks addr as free again. Addresses outside of the pool or not in
+// use are ignored.
+func (a *Allocator) Release(addr netip.Addr) {
+	addr = addr.Unmap()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !searchRanges(a.pool, addr) || searchRanges(a.free, addr) {
+		return
+	}
+	i := sort.Search(len(a.free), func(i int) bool {
+		return a.free[i].From.Compare(addr) > 0
+	})
+	switch {
+	case i > 0 && a.free[i-1].To.Next() == addr && i < len(a.free) && addr.Next() == a.free[i].From:
+		a.free[i-1].To = a.free[i].To
+		a.free = slices.Delete(a.free, i, i+1)
+	case i > 0 && a.free[i-1].To.Next() == addr:
+		a.free[i-1].To = addr
+	case i < len(a.free) && addr.Next() == a.free[i].From:
+		a.free[i].From = addr
+	default:
+		a.free = slices.Insert(a.free, i, Range{From: addr, To: addr})
+	}
+}
@@ -0,0 +1,114 @@
+package megapool
+
+import (
+	"net/netip"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestAllocator(t *testing.T) {
+	m, _ := NewMegapool("1.1.1.5,1.1.1.1-1.1.1.3,2001:db8::/127")
+	alloc := NewAllocator(m)
+	want := []netip.Addr{a("1.1.1.1"), a("1.1.1.2"), a("1.1.1.3"), a("1.1.1.5"), a("2001:db8::"), a("2001:db8::1")}
+	var got []netip.Addr
+	for {
+		addr, ok := alloc.Allocate()
+		if !ok {
+			break
+		}
+		got = append(got, addr)
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("Allocator.Allocate() = %v, want %v", got, want)
+	}
+	if addr, ok := alloc.Allocate(); ok {
+		t.Errorf("Allocator.Allocate() = %v, %v after exhaustion, want false", addr, ok)
+	}
+
+	alloc.Release(a("1.1.1.4"))
+	alloc.Release(a("9.9.9.9"))
+	if addr, ok := alloc.Allocate(); ok {
+		t.Errorf("Allocator.Allocate() = %v, %v after releasing addresses outside the pool, want false", addr, ok)
+	}
+
+	alloc.Release(a("1.1.1.5"))
+	alloc.Release(a("1.1.1.2"))
+	alloc.Release(a("1.1.1.2"))
+	alloc.Release(a("::ffff:1.1.1.3"))
+	alloc.Release(a("1.1.1.1"))
+	want = []netip.Addr{a("1.1.1.1"), a("1.1.1.2"), a("1.1.1.3"), a("1.1.1.5")}
+	got = nil
+	for {
+		addr, ok := alloc.Allocate()
+		if !ok {
+			break
+		}
+		got = append(got, addr)
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("Allocator.Allocate() after release = %v, want %v", got, want)
+	}
+}
+
+func TestAllocator_Empty(t *testing.T) {
+	alloc := NewAllocator(Megapool{})
+	if addr, ok := alloc.Allocate(); ok {
+		t.Errorf("Allocator.Allocate() = %v, %v, want false", addr, ok)
+	}
+}
+
+func TestAllocator_Concurrent(t *testing.T) {
+	m, _ := NewMegapool("10.0.0.0/22")
+	alloc := NewAllocator(m)
+	drain := func() map[netip.Addr]bool {
+		var mu sync.Mutex
+		seen := map[netip.Addr]bool{}
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					addr, ok := alloc.Allocate()
+					if !ok {
+						return
+					}
+					mu.Lock()
+					if seen[addr] {
+						t.Errorf("Allocator.Allocate() returned %v twice", addr)
+					}
+					seen[addr] = true
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		return seen
+	}
+	seen := drain()
+	if len(seen) != 1024 {
+		t.Fatalf("Allocator.Allocate() handed out %d addresses, want %d", len(seen), 1024)
+	}
+	var wg sync.WaitGroup
+	for addr := range seen {
+		if addr.As4()[3]%2 != 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(addr netip.Addr) {
+			defer wg.Done()
+			alloc.Release(addr)
+		}(addr)
+	}
+	wg.Wait()
+	again := drain()
+	if len(again) != 512 {
+		t.Errorf("Allocator.Allocate() handed out %d addresses after release, want %d", len(again), 512)
+	}
+	for addr := range again {
+		if addr.As4()[3]%2 != 0 {
+			t.Errorf("Allocator.Allocate() = %v after release, which was never released", addr)
+		}
+	}
+}
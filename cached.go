@@ -0,0 +1,58 @@
+package megapool
+
+import (
+	"hash/maphash"
+	"math/big"
+	"net/netip"
+)
+
+// CachedMegapool is a Megapool remembering its Size. The cached size is keyed
+// by a fingerprint of the entries, so it is recomputed after any change, be it
+// through Add or by editing the exported slices directly. Computing the
+// fingerprint is linear in the number of entries, without the sorting and
+// merging Size needs.
+type CachedMegapool struct {
+	Megapool
+
+	seed        maphash.Seed
+	fingerprint uint64
+	size        *big.Int
+}
+
+// NewCachedMegapool returns a CachedMegapool holding the entries of m.
+func NewCachedMegapool(m Megapool) *CachedMegapool {
+	return &CachedMegapool{Megapool: m, seed: maphash.MakeSeed()}
+}
+
+// Size is Megapool.Size, computed again only when the pool changed since the
+// last call.
+func (c *CachedMegapool) Size() *big.Int {
+	if fp := c.fingerprintOf(); c.size == nil || fp != c.fingerprint {
+		c.size, c.fingerprint = c.Megapool.Size(), fp
+	}
+	return new(big.Int).Set(c.size)
+}
+
+func (c *CachedMegapool) fingerprintOf() uint64 {
+	var h maphash.Hash
+	h.SetSeed(c.seed)
+	writeAddr := func(a netip.Addr) {
+		b := a.As16()
+		h.Write(b[:])
+		h.WriteByte(byte(a.BitLen()))
+	}
+	for _, v := range c.IPPool {
+		writeAddr(v)
+	}
+	h.WriteByte(0)
+	for _, v := range c.PrefixPool {
+		writeAddr(v.Addr())
+		h.WriteByte(byte(v.Bits()))
+	}
+	h.WriteByte(0)
+	for _, v := range c.RangePool {
+		writeAddr(v.From)
+		writeAddr(v.To)
+	}
+	return h.Sum64()
+}
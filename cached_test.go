@@ -0,0 +1,51 @@
+package megapool
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestCachedMegapool_Size(t *testing.T) {
+	m, _ := NewMegapool("1.1.1.0/24,1.1.1.1")
+	c := NewCachedMegapool(m)
+	if got := c.Size().String(); got != "256" {
+		t.Errorf("CachedMegapool.Size() = %v, want %v", got, "256")
+	}
+	c.Size().SetInt64(0)
+	if got := c.Size().String(); got != "256" {
+		t.Errorf("CachedMegapool.Size() = %v after changing a returned size, want %v", got, "256")
+	}
+	if err := c.Add("1.1.2.0/25"); err != nil {
+		t.Fatalf("CachedMegapool.Add() error = %v", err)
+	}
+	if got := c.Size().String(); got != "384" {
+		t.Errorf("CachedMegapool.Size() = %v after Add, want %v", got, "384")
+	}
+	c.PrefixPool[1] = netip.MustParsePrefix("1.1.2.0/24")
+	if got := c.Size().String(); got != "512" {
+		t.Errorf("CachedMegapool.Size() = %v after editing PrefixPool, want %v", got, "512")
+	}
+	c.IPPool = nil
+	if got := c.Size().String(); got != "512" {
+		t.Errorf("CachedMegapool.Size() = %v after dropping a shadowed IP, want %v", got, "512")
+	}
+}
+
+func BenchmarkMegapool_Size(b *testing.B) {
+	m, _ := NewMegapool(largeInput(10000))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		m.Size()
+	}
+}
+
+func BenchmarkCachedMegapool_Size(b *testing.B) {
+	m, _ := NewMegapool(largeInput(10000))
+	c := NewCachedMegapool(m)
+	c.Size()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.Size()
+	}
+}
@@ -0,0 +1,84 @@
+package megapool
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// ToCSV returns one row per entry, IPs first, then CIDR blocks and ranges,
+// in the form read by FromCSV:
+//
+//	ip,1.1.1.1
+//	cidr,10.0.0.0/8
+//	range,1.1.1.1,1.1.1.10
+func (m *Megapool) ToCSV() [][]string {
+	rows := make([][]string, 0, m.Len())
+	for _, v := range m.IPPool {
+		rows = append(rows, []string{"ip", v.String()})
+	}
+	for _, v := range m.PrefixPool {
+		rows = append(rows, []string{"cidr", v.String()})
+	}
+	for _, v := range m.RangePool {
+		rows = append(rows, []string{"range", v.From.String(), v.To.String()})
+	}
+	return rows
+}
+
+// FromCSV parses the rows written by ToCSV. Unlike NewMegapool it accepts
+// ranges spanning several last-octet blocks, as produced by the set
+// operations.
+func FromCSV(rows [][]string) (Megapool, error) {
+	var m Megapool
+	for i, row := range rows {
+		if err := m.parseCSVRow(row); err != nil {
+			return Megapool{}, fmt.Errorf("row %d: %w", i+1, err)
+		}
+	}
+	return m, nil
+}
+
+func (m *Megapool) parseCSVRow(row []string) error {
+	if len(row) == 0 {
+		return fmt.Errorf("empty row")
+	}
+	want := map[string]int{"ip": 2, "cidr": 2, "range": 3}[row[0]]
+	if want == 0 {
+		return fmt.Errorf("%w: unknown entry type: value=%v", ErrBadElement, row[0])
+	}
+	if len(row) != want {
+		return fmt.Errorf("%v row takes %d columns, got %d", row[0], want, len(row))
+	}
+	switch row[0] {
+	case "ip":
+		a, err := netip.ParseAddr(row[1])
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrBadElement, err)
+		}
+		m.IPPool = append(m.IPPool, a.Unmap())
+	case "cidr":
+		p, err := netip.ParsePrefix(row[1])
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrBadElement, err)
+		}
+		m.PrefixPool = append(m.PrefixPool, unmapPrefix(p))
+	case "range":
+		from, err := netip.ParseAddr(row[1])
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrBadElement, err)
+		}
+		to, err := netip.ParseAddr(row[2])
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrBadElement, err)
+		}
+		from, to = from.Unmap(), to.Unmap()
+		if from.Is4() != to.Is4() {
+			return fmt.Errorf("not an accepted range: %w: value=%v-%v", ErrMixedFamily, from, to)
+		}
+		if from.Compare(to) > 0 {
+			return fmt.Errorf("not an accepted range: %w: from=%v, to=%v", ErrReversedRange, from, to)
+		}
+		m.RangePool = append(m.RangePool, Range{From: from, To: to})
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package megapool
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+func TestMegapool_ToCSV(t *testing.T) {
+	tests := []struct {
+		name string
+		main string
+		want [][]string
+	}{
+		{"empty", "", [][]string{}},
+		{"every type", "1.1.1.1-1.1.1.10,10.0.0.0/8,1.1.1.1", [][]string{
+			{"ip", "1.1.1.1"},
+			{"cidr", "10.0.0.0/8"},
+			{"range", "1.1.1.1", "1.1.1.10"},
+		}},
+		{"ipv6", "2001:db8::1,2001:db8::/32", [][]string{
+			{"ip", "2001:db8::1"},
+			{"cidr", "2001:db8::/32"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			if got := m.ToCSV(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Megapool.ToCSV() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFromCSV_RoundTrip(t *testing.T) {
+	tests := []string{
+		"",
+		"1.1.1.1",
+		"1.1.1.1,1.1.1.1,10.0.0.0/8,1.1.1.1-1.1.1.10",
+		"2001:db8::1,2001:db8::/32,2001:db8::1-2001:db8::ff,1.1.1.0/24",
+	}
+	for _, input := range tests {
+		t.Run(input, func(t *testing.T) {
+			m, _ := NewMegapool(input)
+			got, err := FromCSV(m.ToCSV())
+			if err != nil {
+				t.Fatalf("FromCSV() error = %v", err)
+			}
+			if got.String() != m.String() {
+				t.Errorf("FromCSV() = %v, want %v", got.String(), m.String())
+			}
+		})
+	}
+}
+
+func TestFromCSV_WideRange(t *testing.T) {
+	m := Megapool{RangePool: []Range{{From: netip.MustParseAddr("1.1.1.1"), To: netip.MustParseAddr("1.1.2.255")}}}
+	got, err := FromCSV(m.ToCSV())
+	if err != nil {
+		t.Fatalf("FromCSV() error = %v", err)
+	}
+	if !got.Equal(m) {
+		t.Errorf("FromCSV() = %v, want %v", got.String(), m.String())
+	}
+}
+
+func TestFromCSV(t *testing.T) {
+	tests := []struct {
+		name    string
+		rows    [][]string
+		want    string
+		wantErr bool
+	}{
+		{"no rows", nil, "", false},
+		{"every type", [][]string{{"range", "1.1.1.1", "1.1.1.10"}, {"ip", "1.1.1.1"}, {"cidr", "10.0.0.0/8"}}, "1.1.1.1,10.0.0.0/8,1.1.1.1-1.1.1.10", false},
+		{"v4-mapped", [][]string{{"ip", "::ffff:1.1.1.1"}, {"cidr", "::ffff:1.1.1.0/120"}}, "1.1.1.1,1.1.1.0/24", false},
+		{"unknown type", [][]string{{"ip", "1.1.1.1"}, {"host", "1.1.1.2"}}, "", true},
+		{"empty row", [][]string{{}}, "", true},
+		{"missing column", [][]string{{"range", "1.1.1.1"}}, "", true},
+		{"extra column", [][]string{{"ip", "1.1.1.1", "web"}}, "", true},
+		{"invalid ip", [][]string{{"ip", "1.1.1"}}, "", true},
+		{"invalid cidr", [][]string{{"cidr", "1.1.1.0/33"}}, "", true},
+		{"reversed range", [][]string{{"range", "1.1.1.10", "1.1.1.1"}}, "", true},
+		{"mixed range", [][]string{{"range", "1.1.1.1", "2001:db8::1"}}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := FromCSV(tt.rows)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("FromCSV() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got.String() != tt.want {
+				t.Errorf("FromCSV() = %v, want %v", got.String(), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,410 @@
+package megapool
+
+import (
+	"context"
+	"encoding/binary"
+	"math/big"
+	"math/bits"
+	"math/rand/v2"
+	"net/netip"
+	"slices"
+	"sort"
+)
+
+// entries returns every entry of the pool as an inclusive address range,
+// in storage order and without any merging.
+func (m *Megapool) entries() []Range {
+	rs := make([]Range, 0, len(m.IPPool)+len(m.PrefixPool)+len(m.RangePool))
+	for _, v := range m.IPPool {
+		rs = append(rs, Range{From: v, To: v})
+	}
+	for _, v := range m.PrefixPool {
+		rs = append(rs, prefixRange(v))
+	}
+	rs = append(rs, m.RangePool...)
+	return rs
+}
+
+// intervals returns the addresses covered by the pool as sorted, disjoint and
+// non-adjacent ranges.
+func (m *Megapool) intervals() []Range {
+	return mergeRanges(m.entries())
+}
+
+func mergeRanges(rs []Range) []Range {
+	if len(rs) == 0 {
+		return nil
+	}
+	sorted := slices.Clone(rs)
+	slices.SortFunc(sorted, Range.Compare)
+	merged := []Range{sorted[0]}
+	for _, r := range sorted[1:] {
+		cur := &merged[len(merged)-1]
+		if r.From.Compare(cur.To) <= 0 || cur.To.Next() == r.From {
+			if r.To.Compare(cur.To) > 0 {
+				cur.To = r.To
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// intersectRanges expects both inputs as returned by mergeRanges.
+func intersectRanges(a, b []Range) []Range {
+	var out []Range
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		from := maxAddr(a[i].From, b[j].From)
+		to := minAddr(a[i].To, b[j].To)
+		if from.Compare(to) <= 0 {
+			out = append(out, Range{From: from, To: to})
+		}
+		if a[i].To.Compare(b[j].To) < 0 {
+			i++
+		} else {
+			j++
+		}
+	}
+	return out
+}
+
+// overlapRanges reports whether a and b share an address. Both inputs are
+// expected as returned by mergeRanges.
+func overlapRanges(a, b []Range) bool {
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if a[i].From.Compare(b[j].To) <= 0 && b[j].From.Compare(a[i].To) <= 0 {
+			return true
+		}
+		if a[i].To.Compare(b[j].To) < 0 {
+			i++
+		} else {
+			j++
+		}
+	}
+	return false
+}
+
+// ctxCheckInterval is the number of steps between checks of the context in
+// the context-aware sweeps.
+const ctxCheckInterval = 4096
+
+// overlapRangesCtx is overlapRanges, giving up with ctx.Err() once ctx is
+// done.
+func overlapRangesCtx(ctx context.Context, a, b []Range) (bool, error) {
+	i, j := 0, 0
+	for step := 0; i < len(a) && j < len(b); step++ {
+		if step%ctxCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return false, err
+			}
+		}
+		if a[i].From.Compare(b[j].To) <= 0 && b[j].From.Compare(a[i].To) <= 0 {
+			return true, nil
+		}
+		if a[i].To.Compare(b[j].To) < 0 {
+			i++
+		} else {
+			j++
+		}
+	}
+	return false, nil
+}
+
+// subtractRanges expects both inputs as returned by mergeRanges.
+func subtractRanges(a, b []Range) []Range {
+	var out []Range
+	j := 0
+	for _, r := range a {
+		for j < len(b) && b[j].To.Compare(r.From) < 0 {
+			j++
+		}
+		cur := r
+		ok := true
+		for k := j; k < len(b) && b[k].From.Compare(cur.To) <= 0; k++ {
+			if b[k].From.Compare(cur.From) > 0 {
+				out = append(out, Range{From: cur.From, To: b[k].From.Prev()})
+			}
+			if b[k].To.Compare(cur.To) >= 0 {
+				ok = false
+				break
+			}
+			cur.From = b[k].To.Next()
+		}
+		if ok {
+			out = append(out, cur)
+		}
+	}
+	return out
+}
+
+// searchRanges reports whether addr is in rs, which is expected as returned by
+// mergeRanges.
+func searchRanges(rs []Range, addr netip.Addr) bool {
+	i := sort.Search(len(rs), func(i int) bool {
+		return rs[i].To.Compare(addr) >= 0
+	})
+	return i < len(rs) && rs[i].From.Compare(addr) <= 0
+}
+
+func (r Range) contains(a netip.Addr) bool {
+	return r.From.Compare(a) <= 0 && r.To.Compare(a) >= 0
+}
+
+func prefixRange(p netip.Prefix) Range {
+	p = p.Masked()
+	return Range{From: p.Addr(), To: lastAddr(p)}
+}
+
+func lastAddr(p netip.Prefix) netip.Addr {
+	b := p.Masked().Addr().AsSlice()
+	for i := p.Bits(); i < len(b)*8; i++ {
+		b[i/8] |= 1 << (7 - i%8)
+	}
+	a, _ := netip.AddrFromSlice(b)
+	return a
+}
+
+func (r Range) size() *big.Int {
+	lo, hi := r.AsBigIntRange()
+	s := hi.Sub(hi, lo)
+	return s.Add(s, big.NewInt(1))
+}
+
+func addrToInt(a netip.Addr) *big.Int {
+	return new(big.Int).SetBytes(a.AsSlice())
+}
+
+func intToAddr(i *big.Int, is6 bool) (netip.Addr, bool) {
+	b := make([]byte, 4)
+	if is6 {
+		b = make([]byte, 16)
+	}
+	if i.Sign() < 0 || i.BitLen() > len(b)*8 {
+		return netip.Addr{}, false
+	}
+	i.FillBytes(b)
+	return netip.AddrFromSlice(b)
+}
+
+func addrToUint32(a netip.Addr) uint32 {
+	b := a.As4()
+	return binary.BigEndian.Uint32(b[:])
+}
+
+// addAddr returns the address n after a, which must not go past the last
+// address of the family.
+func addAddr(a netip.Addr, n uint64) netip.Addr {
+	b := a.As16()
+	hi, lo := binary.BigEndian.Uint64(b[:8]), binary.BigEndian.Uint64(b[8:])
+	lo, carry := bits.Add64(lo, n, 0)
+	hi += carry
+	binary.BigEndian.PutUint64(b[:8], hi)
+	binary.BigEndian.PutUint64(b[8:], lo)
+	sum := netip.AddrFrom16(b)
+	if a.Is4() {
+		return sum.Unmap()
+	}
+	return sum
+}
+
+// permutation is a keyed bijection of [0, n). It mixes indexes over the
+// smallest power of two holding n and walks the cycle until it lands back
+// inside [0, n), which takes less than two rounds on average.
+type permutation struct {
+	n    uint64
+	bits uint
+	keys [4]uint64
+}
+
+func newPermutation(n uint64, seed int64) permutation {
+	p := permutation{n: n, bits: uint(bits.Len64(n))}
+	rng := rand.New(rand.NewPCG(uint64(seed), 0x6d656761706f6f6c))
+	for i := range p.keys {
+		p.keys[i] = rng.Uint64()
+	}
+	return p
+}
+
+func (p permutation) at(i uint64) uint64 {
+	for {
+		i = p.mix(i)
+		if i < p.n {
+			return i
+		}
+	}
+}
+
+// mix is a bijection of the p.bits wide integers: every step, xoring a key,
+// multiplying by an odd number and xoring the high bits into the low ones, can
+// be undone.
+func (p permutation) mix(x uint64) uint64 {
+	mask := uint64(1)<<p.bits - 1
+	for _, k := range p.keys {
+		x = (x ^ k) & mask
+		x = (x * (k | 1)) & mask
+		x ^= x >> ((p.bits + 1) / 2)
+	}
+	return x
+}
+
+func minAddr(a, b netip.Addr) netip.Addr {
+	if a.Compare(b) <= 0 {
+		return a
+	}
+	return b
+}
+
+func maxAddr(a, b netip.Addr) netip.Addr {
+	if a.Compare(b) >= 0 {
+		return a
+	}
+	return b
+}
+
+// appendRangePrefixes appends the decomposition of r to dst, giving up and
+// returning false once dst would hold more than max prefixes. A negative max
+// means no limit.
+func appendRangePrefixes(dst []netip.Prefix, r Range, max int) ([]netip.Prefix, bool) {
+	out := dst
+	width := r.From.BitLen()
+	lo := addrToInt(r.From)
+	hi := addrToInt(r.To)
+	one := big.NewInt(1)
+	for lo.Cmp(hi) <= 0 {
+		k := width
+		if lo.Sign() != 0 {
+			k = int(lo.TrailingZeroBits())
+		}
+		rem := new(big.Int).Sub(hi, lo)
+		rem.Add(rem, one)
+		if n := rem.BitLen() - 1; n < k {
+			k = n
+		}
+		if max >= 0 && len(out) == max {
+			return out, false
+		}
+		a, _ := intToAddr(lo, r.From.Is6())
+		out = append(out, netip.PrefixFrom(a, width-k))
+		lo.Add(lo, new(big.Int).Lsh(one, uint(k)))
+	}
+	return out, true
+}
+
+// fromIntervals builds a pool holding exactly the addresses of ivs, expressed
+// as AsIs.
+func fromIntervals(ivs []Range) Megapool {
+	return fromIntervalsAs(ivs, AsIs)
+}
+
+// fromIntervalsAs builds a pool holding exactly the addresses of ivs in the
+// given representation. Ranges are always confined to a single last-octet
+// block so that the result parses back with NewMegapool.
+func fromIntervalsAs(ivs []Range, rep Representation) Megapool {
+	var m Megapool
+	for _, iv := range ivs {
+		switch rep {
+		case PreferCIDRs:
+			m.PrefixPool = append(m.PrefixPool, iv.AsPrefixes()...)
+		case PreferRanges:
+			for from := iv.From; ; {
+				to := minAddr(blockEnd(from), iv.To)
+				if from == to {
+					m.IPPool = append(m.IPPool, from)
+				} else {
+					m.RangePool = append(m.RangePool, Range{From: from, To: to})
+				}
+				if to == iv.To {
+					break
+				}
+				from = to.Next()
+			}
+		default:
+			var chunk []netip.Prefix
+			for _, p := range iv.AsPrefixes() {
+				if p.Addr().BitLen()-p.Bits() >= 8 {
+					m.appendChunk(chunk)
+					chunk = nil
+					m.PrefixPool = append(m.PrefixPool, p)
+					continue
+				}
+				if len(chunk) > 0 && !sameBlock(chunk[0].Addr(), p.Addr()) {
+					m.appendChunk(chunk)
+					chunk = nil
+				}
+				chunk = append(chunk, p)
+			}
+			m.appendChunk(chunk)
+		}
+	}
+	return m
+}
+
+func (m *Megapool) appendChunk(chunk []netip.Prefix) {
+	switch {
+	case len(chunk) == 0:
+	case len(chunk) == 1 && chunk[0].IsSingleIP():
+		m.IPPool = append(m.IPPool, chunk[0].Addr())
+	case len(chunk) == 1:
+		m.PrefixPool = append(m.PrefixPool, chunk[0])
+	default:
+		m.RangePool = append(m.RangePool, Range{From: chunk[0].Addr(), To: lastAddr(chunk[len(chunk)-1])})
+	}
+}
+
+// blockEnd returns the last address sharing all but the last octet with a.
+func blockEnd(a netip.Addr) netip.Addr {
+	b := a.AsSlice()
+	b[len(b)-1] = 0xff
+	e, _ := netip.AddrFromSlice(b)
+	return e
+}
+
+// sameBlock reports whether a and b differ only in their last octet.
+func sameBlock(a, b netip.Addr) bool {
+	as, bs := a.AsSlice(), b.AsSlice()
+	return len(as) == len(bs) && slices.Equal(as[:len(as)-1], bs[:len(bs)-1])
+}
+
+// commonPrefixLen returns the number of leading bits shared by a and b, which
+// must be of the same family.
+func commonPrefixLen(a, b netip.Addr) int {
+	as, bs := a.AsSlice(), b.AsSlice()
+	for i := range as {
+		if x := as[i] ^ bs[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return len(as) * 8
+}
+
+// comparePrefix orders prefixes by network address, then by length.
+func comparePrefix(a, b netip.Prefix) int {
+	if c := a.Masked().Addr().Compare(b.Masked().Addr()); c != 0 {
+		return c
+	}
+	if c := a.Bits() - b.Bits(); c != 0 {
+		return c
+	}
+	return a.Addr().Compare(b.Addr())
+}
+
+// clone returns a copy of the pool not sharing its slices.
+func (m *Megapool) clone() Megapool {
+	return Megapool{
+		IPPool:     slices.Clone(m.IPPool),
+		PrefixPool: slices.Clone(m.PrefixPool),
+		RangePool:  slices.Clone(m.RangePool),
+	}
+}
+
+// sorted returns a copy of the pool with every category sorted.
+func (m *Megapool) sorted() Megapool {
+	s := m.clone()
+	slices.SortFunc(s.IPPool, netip.Addr.Compare)
+	slices.SortFunc(s.PrefixPool, comparePrefix)
+	slices.SortFunc(s.RangePool, Range.Compare)
+	return s
+}
@@ -1,14 +1,22 @@
 package megapool
 
 import (
+	"bufio"
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"iter"
 	"log/slog"
-	"math"
+	"maps"
+	"math/big"
+	"net"
 	"net/netip"
+	"runtime"
 	"slices"
 	"sort"
 	"strings"
+	"sync"
 )
 
 type Megapool struct {
@@ -22,44 +30,699 @@ type Range struct {
 	To   netip.Addr
 }
 
-func NewMegapool(input string) (Megapool, error) {
-	var ipPool []netip.Addr
-	var prefixPool []netip.Prefix
-	var rangePool []Range
+// parallelParseThreshold is the number of items from which NewMegapool spreads
+// parsing over several goroutines.
+const parallelParseThreshold = 20000
+
+// parseConfig holds the parsing variations offered by the NewMegapool*
+// constructors.
+type parseConfig struct {
+	// exclusiveRanges treats the upper bound of ranges as exclusive.
+	exclusiveRanges bool
+	// singleAddressRanges accepts ranges whose endpoints are equal.
+	singleAddressRanges bool
+	// wildcards accepts IPv4 addresses with trailing * octets.
+	wildcards bool
+	// presize reserves room in each category before parsing, see
+	// NewMegapoolWithCapacity.
+	presize bool
+	// hint is the expected number of entries when presize is set, 0 derives
+	// it from the input.
+	hint int
+	// capacity is the room reserved for IPs, CIDR blocks and ranges.
+	capacity [3]int
+	// lines splits the input on newlines only.
+	lines bool
+	// firstToken parses only the first whitespace-separated token of every
+	// entry.
+	firstToken bool
+	// collectErrors skips the messages of BuildFromChan that fail to parse
+	// instead of stopping at the first.
+	collectErrors bool
+	// commentPrefixes marks the lines and entries to skip.
+	commentPrefixes []string
+	// tags, when not nil, collects the label of every tagged entry, see
+	// NewTaggedMegapool.
+	tags map[string]string
+}
+
+// Option changes how NewMegapool parses its input.
+type Option func(*parseConfig)
+
+// WithSingleAddressRanges accepts degenerate ranges such as 1.1.1.5-1.1.1.5 and
+// stores them as the single IP they describe. Without it such ranges are
+// rejected.
+func WithSingleAddressRanges() Option {
+	return func(c *parseConfig) {
+		c.singleAddressRanges = true
+	}
+}
+
+// WithExclusiveRanges treats the upper bound of ranges as exclusive, so
+// 1.1.1.0-1.1.1.10 holds 10 addresses. Ranges are stored inclusive, i.e. as
+// 1.1.1.0-1.1.1.9, and String prints them that way: parsing String again
+// with this option drops the last address of every range.
+func WithExclusiveRanges() Option {
+	return func(c *parseConfig) {
+		c.exclusiveRanges = true
+	}
+}
+
+// WithLinesOnly splits the input on newlines only, so that a line holding
+// commas or semicolons is parsed, and rejected, as a single entry.
+func WithLinesOnly() Option {
+	return func(c *parseConfig) {
+		c.lines = true
+	}
+}
+
+// WithFirstToken parses only the first whitespace-separated token of every
+// entry and ignores the rest, such as the route attributes in
+// "10.0.0.0/8 65001 65002 i" from BGP prefix dumps.
+func WithFirstToken() Option {
+	return func(c *parseConfig) {
+		c.firstToken = true
+	}
+}
+
+// WithCollectErrors makes BuildFromChan skip the messages that fail to parse
+// instead of stopping at the first one. Once the channel is closed their
+// errors are returned joined, along with the pool of the other messages. It
+// has no effect elsewhere.
+func WithCollectErrors() Option {
+	return func(c *parseConfig) {
+		c.collectErrors = true
+	}
+}
+
+// WithCommentPrefixes skips the lines and entries starting with one of
+// prefixes, such as "; AS13335" in route exports, instead of failing on them.
+// Without prefixes, ";" and "#" are used. Labels such as 1.1.1.0/24#office
+// are still read as labels as they do not start the entry.
+func WithCommentPrefixes(prefixes ...string) Option {
+	if len(prefixes) == 0 {
+		prefixes = []string{";", "#"}
+	}
+	prefixes = slices.DeleteFunc(slices.Clone(prefixes), func(p string) bool {
+		return len(p) == 0
+	})
+	return func(c *parseConfig) {
+		c.commentPrefixes = prefixes
+	}
+}
+
+// WithWildcards accepts IPv4 addresses whose trailing octets are *, such as
+// 1.1.1.* or 1.1.*.*, as the equivalent prefix. Wildcards followed by a
+// number, e.g. 1.*.1.1, are rejected.
+func WithWildcards() Option {
+	return func(c *parseConfig) {
+		c.wildcards = true
+	}
+}
+
+// NewMegapool parses a list of IPs, CIDR blocks and ranges separated by
+// commas, semicolons or newlines. Labels such as #office after an entry are
+// accepted and dropped, use NewTaggedMegapool to keep them.
+func NewMegapool(input string, opts ...Option) (Megapool, error) {
+	var cfg parseConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return parse(input, cfg)
+}
+
+// NewMegapoolExclusiveRanges is NewMegapool with WithExclusiveRanges.
+func NewMegapoolExclusiveRanges(input string, opts ...Option) (Megapool, error) {
+	return NewMegapool(input, append([]Option{WithExclusiveRanges()}, opts...)...)
+}
+
+// ParseError is returned by NewMegapool and the other string constructors for
+// an entry that cannot be parsed.
+type ParseError struct {
+	// Value is the entry as written, without surrounding spaces.
+	Value string
+	// Offset is the byte offset of Value in the input, e.g. to underline it
+	// in a form.
+	Offset int
+	Err    error
+
+	// index is the position of the entry among the split items.
+	index int
+}
+
+func (e *ParseError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+func parse(input string, cfg parseConfig) (Megapool, error) {
+	if len(cfg.commentPrefixes) > 0 {
+		input = blankCommentLines(input, cfg.commentPrefixes)
+	}
 	items := strings.TrimSpace(input)
 	if len(items) == 0 {
 		return Megapool{}, nil
 	}
-	all := strings.FieldsFunc(items, func(r rune) bool {
-		return r == ',' || r == ';' || r == '\n'
+	isSeparator := isItemSeparator
+	if cfg.lines {
+		isSeparator = isLineSeparator
+	}
+	all := strings.FieldsFunc(items, isSeparator)
+	var m Megapool
+	var err error
+	if workers := runtime.GOMAXPROCS(0); workers > 1 && len(all) >= parallelParseThreshold {
+		m, err = parseItemsParallel(all, cfg, workers)
+	} else {
+		if cfg.presize {
+			cfg.capacity = estimateCapacity(all, cfg.hint)
+		}
+		m, err = parseItems(all, cfg)
+	}
+	var pe *ParseError
+	if errors.As(err, &pe) {
+		pe.Offset = strings.Index(input, items) + itemOffset(items, pe.index, isSeparator)
+		for input[pe.Offset] == ' ' || input[pe.Offset] == '\t' {
+			pe.Offset++
+		}
+	}
+	return m, err
+}
+
+// blankCommentLines replaces every line of input starting with one of
+// prefixes by newlines. The other lines keep their byte offsets.
+func blankCommentLines(input string, prefixes []string) string {
+	lines := strings.SplitAfter(input, "\n")
+	for i, l := range lines {
+		if hasAnyPrefix(strings.TrimLeft(l, " \t"), prefixes) {
+			lines[i] = strings.Repeat("\n", len(l))
+		}
+	}
+	return strings.Join(lines, "")
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	return slices.ContainsFunc(prefixes, func(p string) bool {
+		return strings.HasPrefix(s, p)
 	})
-	for _, v := range all {
-		vv := strings.ReplaceAll(strings.ReplaceAll(v, " ", ""), "\t", "")
-		a, err := netip.ParseAddr(vv)
-		slog.Debug("parse megapool item", "step", "parse as ip", "err", err, "item", vv)
-		if err == nil {
-			ipPool = append(ipPool, a)
+}
+
+// estimateCapacity guesses how many of items are IPs, CIDR blocks and ranges
+// from their separators, without parsing them. A hint > 0 is split across the
+// categories in the same proportions.
+func estimateCapacity(items []string, hint int) [3]int {
+	var c [3]int
+	for _, v := range items {
+		switch {
+		case strings.Contains(v, "/"):
+			c[1]++
+		case strings.Contains(v, "-"):
+			c[2]++
+		default:
+			c[0]++
+		}
+	}
+	if hint > 0 && len(items) > 0 {
+		for i := range c {
+			c[i] = (hint*c[i] + len(items) - 1) / len(items)
+		}
+	}
+	return c
+}
+
+func parseItems(all []string, cfg parseConfig) (Megapool, error) {
+	var m Megapool
+	if n := cfg.capacity[0]; n > 0 {
+		m.IPPool = make([]netip.Addr, 0, n)
+	}
+	if n := cfg.capacity[1]; n > 0 {
+		m.PrefixPool = make([]netip.Prefix, 0, n)
+	}
+	if n := cfg.capacity[2]; n > 0 {
+		m.RangePool = make([]Range, 0, n)
+	}
+	for i, v := range all {
+		if err := m.parseItem(v, cfg); err != nil {
+			return Megapool{}, &ParseError{Value: strings.Trim(v, " \t"), Err: err, index: i}
+		}
+	}
+	return m, nil
+}
+
+// parseItemsParallel splits all into one chunk per worker and concatenates
+// the parsed chunks in order, so the result and the reported error are the
+// same as with parseItems.
+func parseItemsParallel(all []string, cfg parseConfig, workers int) (Megapool, error) {
+	total := len(all)
+	size := (total + workers - 1) / workers
+	var chunks [][]string
+	for len(all) > 0 {
+		n := min(size, len(all))
+		chunks = append(chunks, all[:n])
+		all = all[n:]
+	}
+	parsed := make([]Megapool, len(chunks))
+	tags := make([]map[string]string, len(chunks))
+	errs := make([]error, len(chunks))
+	var wg sync.WaitGroup
+	for i, chunk := range chunks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cfg := cfg
+			if cfg.presize {
+				cfg.capacity = estimateCapacity(chunk, cfg.hint*len(chunk)/total)
+			}
+			if cfg.tags != nil {
+				cfg.tags = map[string]string{}
+				tags[i] = cfg.tags
+			}
+			parsed[i], errs[i] = parseItems(chunk, cfg)
+		}()
+	}
+	wg.Wait()
+	if i := slices.IndexFunc(errs, func(err error) bool { return err != nil }); i >= 0 {
+		var pe *ParseError
+		if errors.As(errs[i], &pe) {
+			pe.index += i * size
+		}
+		return Megapool{}, errs[i]
+	}
+	var m Megapool
+	if cfg.presize {
+		var ips, prefixes, ranges int
+		for _, p := range parsed {
+			ips, prefixes, ranges = ips+len(p.IPPool), prefixes+len(p.PrefixPool), ranges+len(p.RangePool)
+		}
+		m.IPPool = make([]netip.Addr, 0, ips)
+		m.PrefixPool = make([]netip.Prefix, 0, prefixes)
+		m.RangePool = make([]Range, 0, ranges)
+	}
+	for i, p := range parsed {
+		m.IPPool = append(m.IPPool, p.IPPool...)
+		m.PrefixPool = append(m.PrefixPool, p.PrefixPool...)
+		m.RangePool = append(m.RangePool, p.RangePool...)
+		maps.Copy(cfg.tags, tags[i])
+	}
+	return m, nil
+}
+
+// Add parses items like NewMegapool and appends their entries to the pool.
+// On error the pool is left unchanged.
+func (m *Megapool) Add(items ...string) error {
+	var added Megapool
+	for _, item := range items {
+		p, err := NewMegapool(item)
+		if err != nil {
+			return err
+		}
+		added.IPPool = append(added.IPPool, p.IPPool...)
+		added.PrefixPool = append(added.PrefixPool, p.PrefixPool...)
+		added.RangePool = append(added.RangePool, p.RangePool...)
+	}
+	m.IPPool = append(m.IPPool, added.IPPool...)
+	m.PrefixPool = append(m.PrefixPool, added.PrefixPool...)
+	m.RangePool = append(m.RangePool, added.RangePool...)
+	return nil
+}
+
+// Remove parses items like NewMegapool and removes their addresses from the
+// pool. Entries left untouched keep their form, the others are replaced by
+// what remains of them, e.g. removing 10.0.0.5 from 10.0.0.0/24 leaves
+// 10.0.0.0-10.0.0.4 and 10.0.0.6-10.0.0.255. On error the pool is left
+// unchanged.
+func (m *Megapool) Remove(items ...string) error {
+	var removed Megapool
+	for _, item := range items {
+		p, err := NewMegapool(item)
+		if err != nil {
+			return err
+		}
+		removed.IPPool = append(removed.IPPool, p.IPPool...)
+		removed.PrefixPool = append(removed.PrefixPool, p.PrefixPool...)
+		removed.RangePool = append(removed.RangePool, p.RangePool...)
+	}
+	ivs := removed.intervals()
+	if len(ivs) == 0 {
+		return nil
+	}
+	var out Megapool
+	keep := func(r Range) bool {
+		if !overlapRanges([]Range{r}, ivs) {
+			return true
+		}
+		rest := fromIntervals(subtractRanges([]Range{r}, ivs))
+		out.IPPool = append(out.IPPool, rest.IPPool...)
+		out.PrefixPool = append(out.PrefixPool, rest.PrefixPool...)
+		out.RangePool = append(out.RangePool, rest.RangePool...)
+		return false
+	}
+	for _, v := range m.IPPool {
+		if keep(Range{From: v, To: v}) {
+			out.IPPool = append(out.IPPool, v)
+		}
+	}
+	for _, v := range m.PrefixPool {
+		if keep(prefixRange(v)) {
+			out.PrefixPool = append(out.PrefixPool, v)
+		}
+	}
+	for _, v := range m.RangePool {
+		if keep(v) {
+			out.RangePool = append(out.RangePool, v)
+		}
+	}
+	*m = out
+	return nil
+}
+
+// NewMegapoolFromSources parses every source like NewMegapool and merges the
+// results, e.g. the allow-lists of several files keyed by file name. It also
+// returns the name of the source of every entry, keyed by the entry as
+// printed by String and InternalOverlaps. An entry listed by several sources
+// is attributed to the first of them in name order.
+func NewMegapoolFromSources(sources map[string]string) (Megapool, map[string]string, error) {
+	var m Megapool
+	origins := map[string]string{}
+	for _, name := range slices.Sorted(maps.Keys(sources)) {
+		p, err := NewMegapool(sources[name])
+		if err != nil {
+			return Megapool{}, nil, fmt.Errorf("source %v: %w", name, err)
+		}
+		for _, entry := range p.AsSlice() {
+			if _, ok := origins[entry]; !ok {
+				origins[entry] = name
+			}
+		}
+		m.IPPool = append(m.IPPool, p.IPPool...)
+		m.PrefixPool = append(m.PrefixPool, p.PrefixPool...)
+		m.RangePool = append(m.RangePool, p.RangePool...)
+	}
+	return m, origins, nil
+}
+
+// NewMegapoolLines is NewMegapool with WithLinesOnly.
+func NewMegapoolLines(input string, opts ...Option) (Megapool, error) {
+	return NewMegapool(input, append([]Option{WithLinesOnly()}, opts...)...)
+}
+
+// NewMegapoolCIDROnly behaves like NewMegapool but rejects bare IPs and ranges.
+func NewMegapoolCIDROnly(input string) (Megapool, error) {
+	m, err := NewMegapool(input)
+	if err != nil {
+		return Megapool{}, err
+	}
+	if len(m.IPPool) > 0 {
+		a := m.IPPool[0]
+		return Megapool{}, fmt.Errorf("not a cidr block: value=%v, use %v instead", a, netip.PrefixFrom(a, a.BitLen()))
+	}
+	if len(m.RangePool) > 0 {
+		r := m.RangePool[0]
+		var ps []string
+		for _, p := range r.AsPrefixes() {
+			ps = append(ps, p.String())
+		}
+		return Megapool{}, fmt.Errorf("not a cidr block: value=%v, use %v instead", r.String(), strings.Join(ps, ","))
+	}
+	return m, nil
+}
+
+// NewMegapoolNoRanges behaves like NewMegapool but rejects ranges.
+func NewMegapoolNoRanges(input string) (Megapool, error) {
+	m, err := NewMegapool(input)
+	if err != nil {
+		return Megapool{}, err
+	}
+	if len(m.RangePool) > 0 {
+		r := m.RangePool[0]
+		var ps []string
+		for _, p := range r.AsPrefixes() {
+			if p.IsSingleIP() {
+				ps = append(ps, p.Addr().String())
+			} else {
+				ps = append(ps, p.String())
+			}
+		}
+		return Megapool{}, fmt.Errorf("not an ip or cidr block: value=%v, use %v instead", r.String(), strings.Join(ps, ","))
+	}
+	return m, nil
+}
+
+// NewMegapoolWithCapacity behaves like NewMegapool but reserves room for
+// every category before parsing, saving reallocations on large inputs. The
+// room is estimated from the separators of each entry and, for a hint > 0,
+// scaled so that hint entries fit in total.
+func NewMegapoolWithCapacity(input string, hint int, opts ...Option) (Megapool, error) {
+	cfg := parseConfig{presize: true, hint: hint}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return parse(input, cfg)
+}
+
+// NewMegapoolFromReaderCtx parses r line by line, accepting the same syntax as
+// NewMegapool. ctx is checked before every line and onLine, when not nil, is
+// called with the number of lines parsed so far.
+func NewMegapoolFromReaderCtx(ctx context.Context, r io.Reader, onLine func(n int)) (Megapool, error) {
+	var m Megapool
+	br := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		if err := ctx.Err(); err != nil {
+			return Megapool{}, err
+		}
+		line, err := br.ReadString('\n')
+		if len(line) > 0 {
+			if items := strings.TrimSpace(line); len(items) > 0 {
+				for _, v := range splitItems(items) {
+					if err := m.parseItem(v, parseConfig{}); err != nil {
+						return Megapool{}, fmt.Errorf("line %d: %w", n, err)
+					}
+				}
+			}
+			if onLine != nil {
+				onLine(n)
+			}
+		}
+		if err == io.EOF {
+			return m, nil
+		}
+		if err != nil {
+			return Megapool{}, err
+		}
+	}
+}
+
+// BuildFromChan parses every message received on ch like NewMegapool and
+// merges the results until ch is closed. It fails on the first message that
+// does not parse, see WithCollectErrors, and with ctx.Err() once ctx is done.
+func BuildFromChan(ctx context.Context, ch <-chan string, opts ...Option) (Megapool, error) {
+	var cfg parseConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	var m Megapool
+	var errs []error
+	for n := 1; ; n++ {
+		if err := ctx.Err(); err != nil {
+			return Megapool{}, err
+		}
+		var msg string
+		select {
+		case <-ctx.Done():
+			return Megapool{}, ctx.Err()
+		case v, ok := <-ch:
+			if !ok {
+				return m, errors.Join(errs...)
+			}
+			msg = v
+		}
+		p, err := parse(msg, cfg)
+		if err != nil {
+			err = fmt.Errorf("message %d: %w", n, err)
+			if !cfg.collectErrors {
+				return Megapool{}, err
+			}
+			errs = append(errs, err)
 			continue
 		}
-		p, err := netip.ParsePrefix(vv)
-		slog.Debug("parse megapool item", "step", "parse as cidr block", "err", err, "item", vv)
-		if err == nil {
-			prefixPool = append(prefixPool, p)
+		m.IPPool = append(m.IPPool, p.IPPool...)
+		m.PrefixPool = append(m.PrefixPool, p.PrefixPool...)
+		m.RangePool = append(m.RangePool, p.RangePool...)
+	}
+}
+
+func splitItems(items string) []string {
+	return strings.FieldsFunc(items, isItemSeparator)
+}
+
+func isItemSeparator(r rune) bool {
+	return r == ',' || r == ';' || r == '\n'
+}
+
+func isLineSeparator(r rune) bool {
+	return r == '\n' || r == '\r'
+}
+
+// itemOffset returns the byte offset in items of the i-th element returned by
+// strings.FieldsFunc(items, isSeparator).
+func itemOffset(items string, i int, isSeparator func(rune) bool) int {
+	start := -1
+	for j, r := range items {
+		if !isSeparator(r) {
+			if start < 0 {
+				start = j
+			}
 			continue
 		}
-		r, err := parseRange(vv)
+		if start >= 0 {
+			if i == 0 {
+				return start
+			}
+			i--
+			start = -1
+		}
+	}
+	return start
+}
+
+func (m *Megapool) parseItem(v string, cfg parseConfig) error {
+	if hasAnyPrefix(strings.TrimLeft(v, " \t"), cfg.commentPrefixes) {
+		return nil
+	}
+	v, tag, tagged := strings.Cut(v, "#")
+	if cfg.firstToken {
+		if fields := strings.Fields(v); len(fields) > 0 {
+			v = fields[0]
+		}
+	}
+	vv := strings.ReplaceAll(strings.ReplaceAll(v, " ", ""), "\t", "")
+	vv, err := stripQuotes(vv)
+	if err != nil {
+		return err
+	}
+	vv, err = stripBrackets(vv)
+	if err != nil {
+		return err
+	}
+	// A trailing dot, as in 1.1.1.1., is a common copy artifact.
+	vv = strings.TrimSuffix(vv, ".")
+	// Building the debug attributes allocates, skip it unless they are logged.
+	debug := slog.Default().Enabled(context.Background(), slog.LevelDebug)
+	a, err := netip.ParseAddr(vv)
+	if debug {
+		slog.Debug("parse megapool item", "step", "parse as ip", "err", err, "item", vv)
+	}
+	if err == nil {
+		a = a.Unmap()
+		m.IPPool = append(m.IPPool, a)
+		if tagged && cfg.tags != nil {
+			cfg.setTag(a.String(), tag)
+		}
+		return nil
+	}
+	if cfg.wildcards && strings.Contains(vv, "*") {
+		p, err := parseWildcard(vv)
+		if debug {
+			slog.Debug("parse megapool item", "step", "parse as wildcard", "err", err, "item", vv)
+		}
+		if err != nil {
+			return err
+		}
+		m.PrefixPool = append(m.PrefixPool, p)
+		if tagged && cfg.tags != nil {
+			cfg.setTag(p.String(), tag)
+		}
+		return nil
+	}
+	p, err := netip.ParsePrefix(vv)
+	if debug {
+		slog.Debug("parse megapool item", "step", "parse as cidr block", "err", err, "item", vv)
+	}
+	if err == nil {
+		p = unmapPrefix(p)
+		m.PrefixPool = append(m.PrefixPool, p)
+		if tagged && cfg.tags != nil {
+			cfg.setTag(p.String(), tag)
+		}
+		return nil
+	}
+	if a, ok := parseSingleAddressRange(vv); ok && cfg.singleAddressRanges {
+		m.IPPool = append(m.IPPool, a)
+		if tagged && cfg.tags != nil {
+			cfg.setTag(a.String(), tag)
+		}
+		return nil
+	}
+	parse := parseRange
+	if cfg.exclusiveRanges {
+		parse = parseExclusiveRange
+	}
+	r, err := parse(vv)
+	if debug {
 		slog.Debug("parse megapool item", "step", "parse as range", "err", err, "item", vv)
-		if err == nil {
-			rangePool = append(rangePool, r)
-			continue
+	}
+	if errors.Is(err, ErrMixedFamily) || errors.Is(err, ErrReversedRange) {
+		return fmt.Errorf("%w: value=%v", err, vv)
+	}
+	if err == nil && r.From == r.To {
+		m.IPPool = append(m.IPPool, r.From)
+		if tagged && cfg.tags != nil {
+			cfg.setTag(r.From.String(), tag)
 		}
-		return Megapool{}, fmt.Errorf("not an ip, cidr block or ip range: value=%v", vv)
+		return nil
+	}
+	if err == nil {
+		m.RangePool = append(m.RangePool, r)
+		if tagged && cfg.tags != nil {
+			cfg.setTag(r.String(), tag)
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: value=%v", ErrBadElement, vv)
+}
+
+func (c parseConfig) setTag(entry, tag string) {
+	if tag = strings.TrimSpace(tag); len(tag) == 0 {
+		return
+	}
+	c.tags[entry] = tag
+}
+
+// stripQuotes removes the single or double quotes around values copied from
+// JSON or YAML, such as "1.1.1.1".
+func stripQuotes(v string) (string, error) {
+	isQuote := func(c byte) bool { return c == '"' || c == '\'' }
+	if v == "" || !isQuote(v[0]) && !isQuote(v[len(v)-1]) {
+		return v, nil
+	}
+	if len(v) < 2 || v[0] != v[len(v)-1] {
+		return "", fmt.Errorf("%w: unbalanced quotes: value=%v", ErrBadElement, v)
+	}
+	return v[1 : len(v)-1], nil
+}
+
+// stripBrackets removes the brackets around IPv6 hosts copied from URLs, such
+// as [2001:db8::1].
+func stripBrackets(v string) (string, error) {
+	opened, closed := strings.HasPrefix(v, "["), strings.HasSuffix(v, "]")
+	if opened != closed {
+		return "", fmt.Errorf("%w: unbalanced brackets: value=%v", ErrBadElement, v)
 	}
-	return Megapool{
-		IPPool:     ipPool,
-		PrefixPool: prefixPool,
-		RangePool:  rangePool,
-	}, nil
+	if opened {
+		return v[1 : len(v)-1], nil
+	}
+	return v, nil
+}
+
+// unmapPrefix turns a prefix of v4-mapped v6 addresses such as
+// ::ffff:1.2.3.0/120 into the equivalent v4 prefix.
+func unmapPrefix(p netip.Prefix) netip.Prefix {
+	if !p.Addr().Is4In6() || p.Bits() < 96 {
+		return p
+	}
+	return netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
 }
 
 func (m *Megapool) HasOnlyIPv4() bool {
@@ -76,171 +739,997 @@ func (m *Megapool) HasOnlyIPv4() bool {
 			return false
 		}
 	}
-	for _, p := range m.RangePool {
-		if !p.From.Is4() {
-			return false
-		}
+	for _, p := range m.RangePool {
+		if !p.From.Is4() {
+			return false
+		}
+	}
+	return true
+}
+
+// parseWildcard turns 1.1.1.* into 1.1.1.0/24, 1.1.*.* into 1.1.0.0/16 and
+// so on.
+func parseWildcard(w string) (netip.Prefix, error) {
+	octets := strings.Split(w, ".")
+	if len(octets) != 4 {
+		return netip.Prefix{}, fmt.Errorf("%w: not an accepted wildcard: value=%v", ErrBadElement, w)
+	}
+	bits := 32
+	for i := len(octets) - 1; i >= 0 && octets[i] == "*"; i-- {
+		octets[i] = "0"
+		bits -= 8
+	}
+	a, err := netip.ParseAddr(strings.Join(octets, "."))
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("%w: not an accepted wildcard: value=%v", ErrBadElement, w)
+	}
+	return netip.PrefixFrom(a, bits), nil
+}
+
+// parseSingleAddressRange parses ranges like 1.1.1.5-1.1.1.5 that parseRange
+// rejects as degenerate.
+func parseSingleAddressRange(r string) (netip.Addr, bool) {
+	from, to, ok := strings.Cut(r, "-")
+	if !ok {
+		return netip.Addr{}, false
+	}
+	a, err := netip.ParseAddr(from)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	b, err := netip.ParseAddr(to)
+	if err != nil || a.Unmap() != b.Unmap() {
+		return netip.Addr{}, false
+	}
+	return a.Unmap(), true
+}
+
+// The errors returned when parsing fails wrap one of these, so that
+// errors.Is tells the causes apart.
+var (
+	// ErrMixedFamily is returned for ranges going from an IPv4 to an IPv6
+	// address or the other way round.
+	ErrMixedFamily = errors.New("ipv4 and ipv6 addresses cannot be mixed")
+	// ErrReversedRange is returned for ranges whose start is greater than
+	// their end.
+	ErrReversedRange = errors.New("range start is greater than its end")
+	// ErrBadElement is returned for entries that are not an IP, a CIDR block
+	// or a range.
+	ErrBadElement = errors.New("not an ip, cidr block or ip range")
+)
+
+func parseRange(r string) (Range, error) {
+	from, to, err := parseRangeEnds(r)
+	if err != nil {
+		return Range{}, err
+	}
+	if from == to {
+		return Range{}, errors.New("not an accepted range")
+	}
+	return blockRange(from, to)
+}
+
+// parseExclusiveRange parses a range whose upper bound is excluded, so that
+// 1.1.1.0-1.1.2.0 covers the whole 1.1.1.0/24 block. A range of a single
+// address comes back with From equal to To.
+func parseExclusiveRange(r string) (Range, error) {
+	from, to, err := parseRangeEnds(r)
+	if err != nil {
+		return Range{}, err
+	}
+	if from == to {
+		return Range{}, errors.New("not an accepted range")
+	}
+	if to = to.Prev(); from == to {
+		return Range{From: from, To: to}, nil
+	}
+	return blockRange(from, to)
+}
+
+func parseRangeEnds(r string) (netip.Addr, netip.Addr, error) {
+	items := strings.Split(r, "-")
+	if len(items) != 2 {
+		return netip.Addr{}, netip.Addr{}, errors.New("not an accepted range")
+	}
+
+	from, err := netip.ParseAddr(items[0])
+	if err != nil {
+		return netip.Addr{}, netip.Addr{}, errors.New("not an accepted range")
+	}
+	to, err := netip.ParseAddr(items[1])
+	if err != nil {
+		return netip.Addr{}, netip.Addr{}, errors.New("not an accepted range")
+	}
+	from, to = from.Unmap(), to.Unmap()
+	if from.Is4() != to.Is4() {
+		return netip.Addr{}, netip.Addr{}, fmt.Errorf("not an accepted range: %w", ErrMixedFamily)
+	}
+	if from.Compare(to) > 0 {
+		return netip.Addr{}, netip.Addr{}, fmt.Errorf("not an accepted range: %w", ErrReversedRange)
+	}
+	return from, to, nil
+}
+
+// blockRange accepts from-to only if both ends differ in the last byte alone.
+func blockRange(from, to netip.Addr) (Range, error) {
+	fromSlice := from.AsSlice()
+	toSlice := to.AsSlice()
+	for i := 0; i < len(fromSlice)-1; i++ {
+		if fromSlice[i] != toSlice[i] {
+			return Range{}, errors.New("not an accepted range")
+		}
+	}
+	return Range{From: from, To: to}, nil
+}
+
+// IsEmpty reports whether the pool has no entries.
+func (m *Megapool) IsEmpty() bool {
+	return len(m.IPPool) == 0 && len(m.PrefixPool) == 0 && len(m.RangePool) == 0
+}
+
+// Contains reports whether addr is in the pool.
+func (m *Megapool) Contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, v := range m.IPPool {
+		if v == addr {
+			return true
+		}
+	}
+	for _, v := range m.PrefixPool {
+		if v.Contains(addr) {
+			return true
+		}
+	}
+	for _, v := range m.RangePool {
+		if v.contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// membershipBitmapLimit is the largest span of IPv4 addresses, in bits of
+// memory, CompileMembership turns into a bitmap.
+const membershipBitmapLimit = 1 << 24
+
+// Locate returns the entry containing addr, or false if there is none. If
+// several entries contain addr, the smallest one wins.
+func (m *Megapool) Locate(addr netip.Addr) (string, bool) {
+	addr = addr.Unmap()
+	for _, v := range m.IPPool {
+		if v == addr {
+			return v.String(), true
+		}
+	}
+	var best string
+	var bestSize *big.Int
+	for _, v := range m.PrefixPool {
+		if v.Contains(addr) {
+			if size := prefixRange(v).size(); bestSize == nil || size.Cmp(bestSize) < 0 {
+				best, bestSize = v.String(), size
+			}
+		}
+	}
+	for _, v := range m.RangePool {
+		if v.contains(addr) {
+			if size := v.size(); bestSize == nil || size.Cmp(bestSize) < 0 {
+				best, bestSize = v.String(), size
+			}
+		}
+	}
+	return best, bestSize != nil
+}
+
+// CompileMembership returns a function reporting whether an address is in
+// the pool, like Contains but precomputed for hot paths. IPv4 pools spanning
+// at most 16M addresses are compiled to a bitmap, other pools to a sorted
+// interval list searched in O(log n). The function is safe for concurrent use
+// and does not see later changes to the pool.
+func (m *Megapool) CompileMembership() func(netip.Addr) bool {
+	ivs := m.intervals()
+	if len(ivs) == 0 {
+		return func(netip.Addr) bool { return false }
+	}
+	lo, hi := ivs[0].From, ivs[len(ivs)-1].To
+	if lo.Is4() && hi.Is4() {
+		base, span := addrToUint32(lo), addrToUint32(hi)-addrToUint32(lo)
+		if span < membershipBitmapLimit {
+			bitmap := make([]uint64, span/64+1)
+			for _, r := range ivs {
+				for i, to := addrToUint32(r.From)-base, addrToUint32(r.To)-base; ; i++ {
+					bitmap[i/64] |= 1 << (i % 64)
+					if i == to {
+						break
+					}
+				}
+			}
+			return func(addr netip.Addr) bool {
+				addr = addr.Unmap()
+				if !addr.Is4() {
+					return false
+				}
+				i := addrToUint32(addr) - base
+				return i <= span && bitmap[i/64]&(1<<(i%64)) != 0
+			}
+		}
+	}
+	return func(addr netip.Addr) bool {
+		return searchRanges(ivs, addr.Unmap())
+	}
+}
+
+// Len returns the number of entries in the pool, regardless of how many
+// addresses each of them covers.
+func (m *Megapool) Len() int {
+	return len(m.IPPool) + len(m.PrefixPool) + len(m.RangePool)
+}
+
+// Summary returns a one-line description of the pool such as
+// "3 IPs, 2 CIDRs, 1 range, 772 addresses total". Totals that are too long to
+// read are shortened, e.g. "~1.8e19".
+func (m *Megapool) Summary() string {
+	plural := func(n int, one, many string) string {
+		if n == 1 {
+			return fmt.Sprintf("%d %s", n, one)
+		}
+		return fmt.Sprintf("%d %s", n, many)
+	}
+	total := m.Size().String()
+	if len(total) > 15 {
+		f, _ := new(big.Float).SetString(total)
+		total = "~" + strings.Replace(f.Text('e', 1), "e+", "e", 1)
+	}
+	return fmt.Sprintf("%s, %s, %s, %s addresses total",
+		plural(len(m.IPPool), "IP", "IPs"),
+		plural(len(m.PrefixPool), "CIDR", "CIDRs"),
+		plural(len(m.RangePool), "range", "ranges"),
+		total)
+}
+
+// Overlaps reports whether m shares at least one address with any of others.
+func (m *Megapool) Overlaps(others ...Megapool) bool {
+	if m.IsEmpty() {
+		return false
+	}
+	ivs := m.intervals()
+	for _, o := range others {
+		if o.IsEmpty() {
+			continue
+		}
+		if overlapRanges(ivs, o.intervals()) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAdjacentTo reports whether one of m and other ends at the address right
+// before the other starts, e.g. 1.1.1.0/24 and 1.1.2.0/24. Overlapping and
+// empty pools are not adjacent.
+func (m *Megapool) IsAdjacentTo(other Megapool) bool {
+	if m.IsEmpty() || other.IsEmpty() || m.Overlaps(other) {
+		return false
+	}
+	lo, _ := m.Min()
+	hi, _ := m.Max()
+	otherLo, _ := other.Min()
+	otherHi, _ := other.Max()
+	return hi.Next() == otherLo || otherHi.Next() == lo
+}
+
+// OverlapSize returns the number of distinct addresses shared by m and other,
+// the Size of their Intersection.
+func (m *Megapool) OverlapSize(other Megapool) *big.Int {
+	total := new(big.Int)
+	for _, r := range intersectRanges(m.intervals(), other.intervals()) {
+		total.Add(total, r.size())
+	}
+	return total
+}
+
+// OverlapsExcept reports whether m and other share any address outside of
+// except.
+func (m *Megapool) OverlapsExcept(other, except Megapool) bool {
+	ex := except.intervals()
+	a := subtractRanges(m.intervals(), ex)
+	b := subtractRanges(other.intervals(), ex)
+	return len(intersectRanges(a, b)) > 0
+}
+
+// OverlapsCtx is Overlaps for a single pool, returning ctx.Err() instead once
+// ctx is done. The context is checked before and after sorting each pool and
+// regularly while comparing them.
+func (m *Megapool) OverlapsCtx(ctx context.Context, other Megapool) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	a := m.intervals()
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	b := other.intervals()
+	return overlapRangesCtx(ctx, a, b)
+}
+
+// OverlapsAny returns the index of the first candidate overlapping m. It
+// returns -1 and false when none does or when ctx is done before a match is
+// found, ctx.Err() tells the two apart.
+func (m *Megapool) OverlapsAny(ctx context.Context, candidates []Megapool) (int, bool) {
+	ivs := m.intervals()
+	for i, c := range candidates {
+		if ctx.Err() != nil {
+			return -1, false
+		}
+		if overlapRanges(ivs, c.intervals()) {
+			return i, true
+		}
+	}
+	return -1, false
+}
+
+// OverlapsString parses s with NewMegapool and reports whether it overlaps m.
+// Parse errors are returned rather than treated as no overlap.
+func (m *Megapool) OverlapsString(s string) (bool, error) {
+	other, err := NewMegapool(s)
+	if err != nil {
+		return false, err
+	}
+	return m.Overlaps(other), nil
+}
+
+// Relation describes how the addresses of two pools relate, see
+// Megapool.Relation.
+type Relation int
+
+const (
+	// RelDisjoint pools share no address. An empty pool is disjoint from any
+	// non-empty one.
+	RelDisjoint Relation = iota
+	// RelIntersects means the pools share some addresses, and each has
+	// addresses the other lacks.
+	RelIntersects
+	// RelContains means the pool holds every address of the other, and more.
+	RelContains
+	// RelContainedBy means the other pool holds every address of the pool, and
+	// more.
+	RelContainedBy
+	// RelEqual pools hold the same addresses, in whatever form.
+	RelEqual
+)
+
+// Relation reports how the addresses of m relate to those of other.
+func (m *Megapool) Relation(other Megapool) Relation {
+	a, b := m.intervals(), other.intervals()
+	onlyA, onlyB := len(subtractRanges(a, b)) > 0, len(subtractRanges(b, a)) > 0
+	switch {
+	case !onlyA && !onlyB:
+		return RelEqual
+	case !overlapRanges(a, b):
+		return RelDisjoint
+	case !onlyA:
+		return RelContainedBy
+	case !onlyB:
+		return RelContains
+	default:
+		return RelIntersects
+	}
+}
+
+// ContainsPrefix reports whether every address of p is in the pool, in
+// whichever entries.
+func (m *Megapool) ContainsPrefix(p netip.Prefix) bool {
+	if !p.IsValid() {
+		return false
+	}
+	return len(subtractRanges([]Range{prefixRange(unmapPrefix(p))}, m.intervals())) == 0
+}
+
+// AllowsCIDR parses s as a CIDR block and reports whether it lies entirely
+// within the pool.
+func (m *Megapool) AllowsCIDR(s string) (bool, error) {
+	p, err := netip.ParsePrefix(strings.TrimSpace(s))
+	if err != nil {
+		return false, err
+	}
+	return m.ContainsPrefix(p), nil
+}
+
+func (m *Megapool) HasMinSize(minSize int) bool {
+	min := big.NewInt(int64(minSize))
+	actual := new(big.Int)
+	if actual.Cmp(min) >= 0 {
+		return true
+	}
+	for _, r := range m.entries() {
+		actual.Add(actual, r.size())
+		if actual.Cmp(min) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Unbounded can be passed to HasMaxSize to accept a pool of any size.
+const Unbounded = -1
+
+// HasMaxSize reports whether the pool holds at most maxSize addresses. A
+// maxSize of 0 only accepts the empty pool, use Unbounded for no maximum.
+// Any other negative maxSize is never satisfied.
+func (m *Megapool) HasMaxSize(maxSize int) bool {
+	if maxSize == Unbounded {
+		return true
+	}
+	if maxSize < 0 {
+		return false
+	}
+	max := big.NewInt(int64(maxSize))
+	actual := new(big.Int)
+	for _, r := range m.entries() {
+		actual.Add(actual, r.size())
+		if actual.Cmp(max) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Size returns the number of distinct addresses in the pool. Addresses covered
+// by more than one entry are counted once.
+func (m *Megapool) Size() *big.Int {
+	total := new(big.Int)
+	for _, r := range m.intervals() {
+		total.Add(total, r.size())
+	}
+	return total
+}
+
+// HasAtLeastPrefixLen reports whether the pool holds at least as many
+// addresses as a /bits prefix. The prefix is taken as IPv6 if the pool has
+// any IPv6 entry and as IPv4 otherwise. It returns false for a bits value
+// outside that family's prefix lengths.
+func (m *Megapool) HasAtLeastPrefixLen(bits int) bool {
+	width := 32
+	if slices.ContainsFunc(m.entries(), func(r Range) bool { return r.From.Is6() }) {
+		width = 128
+	}
+	if bits < 0 || bits > width {
+		return false
+	}
+	want := new(big.Int).Lsh(big.NewInt(1), uint(width-bits))
+	return m.Size().Cmp(want) >= 0
+}
+
+// PercentOfIPv4 returns the share of the IPv4 address space covered by the
+// pool, in percent. IPv6 entries are ignored.
+func (m *Megapool) PercentOfIPv4() float64 {
+	total := new(big.Int)
+	for _, r := range m.intervals() {
+		if r.From.Is4() {
+			total.Add(total, r.size())
+		}
+	}
+	pct, _ := new(big.Rat).SetFrac(total.Mul(total, big.NewInt(100)), big.NewInt(1<<32)).Float64()
+	return pct
+}
+
+// Representation selects how Normalize expresses the addresses of a pool.
+type Representation int
+
+const (
+	// AsIs expresses single addresses as IPs, aligned blocks as CIDRs and
+	// anything else as ranges.
+	AsIs Representation = iota
+	// PreferRanges expresses everything as ranges, except single addresses
+	// which stay IPs.
+	PreferRanges
+	// PreferCIDRs expresses everything as CIDR blocks, single addresses
+	// included.
+	PreferCIDRs
+)
+
+// Normalize returns the canonical form of the pool in the given
+// representation: overlapping and adjacent entries are merged and every
+// category is sorted. Ranges never span more than one last-octet block, so the
+// result always parses back with NewMegapool.
+func (m *Megapool) Normalize(rep Representation) Megapool {
+	return fromIntervalsAs(m.intervals(), rep)
+}
+
+// Compact aggregates the pool into as few entries as it takes, e.g. 256
+// consecutive /32s into their /24. It is Normalize(AsIs).
+func (m *Megapool) Compact() Megapool {
+	return m.Normalize(AsIs)
+}
+
+// IsNormalized reports whether the pool is exactly what Normalize(AsIs)
+// returns for it: masked, sorted, with no overlapping or adjacent entries
+// left to merge.
+func (m *Megapool) IsNormalized() bool {
+	n := m.Normalize(AsIs)
+	return slices.Equal(m.IPPool, n.IPPool) &&
+		slices.Equal(m.PrefixPool, n.PrefixPool) &&
+		slices.Equal(m.RangePool, n.RangePool)
+}
+
+// CollapseIPsToRanges returns a copy of the pool in which runs of consecutive
+// IPs are fused into ranges, leaving isolated IPs, prefixes and ranges as they
+// are. Runs are split at last-octet block boundaries so that the result
+// parses back with NewMegapool.
+func (m *Megapool) CollapseIPsToRanges() Megapool {
+	ips := slices.Clone(m.IPPool)
+	slices.SortFunc(ips, netip.Addr.Compare)
+	ips = slices.Compact(ips)
+	out := Megapool{
+		PrefixPool: slices.Clone(m.PrefixPool),
+		RangePool:  slices.Clone(m.RangePool),
+	}
+	for i := 0; i < len(ips); {
+		j := i
+		for j+1 < len(ips) && ips[j+1] == ips[j].Next() && sameBlock(ips[i], ips[j+1]) {
+			j++
+		}
+		if i == j {
+			out.IPPool = append(out.IPPool, ips[i])
+		} else {
+			out.RangePool = append(out.RangePool, Range{From: ips[i], To: ips[j]})
+		}
+		i = j + 1
+	}
+	return out
+}
+
+// CompareSize compares the number of distinct addresses of m and other,
+// returning -1, 0 or +1 like big.Int.Cmp.
+func (m *Megapool) CompareSize(other Megapool) int {
+	return m.Size().Cmp(other.Size())
+}
+
+// Union returns a pool holding the addresses of m and of all others, with
+// duplicates and overlaps merged away.
+func (m *Megapool) Union(others ...Megapool) Megapool {
+	rs := m.entries()
+	for _, o := range others {
+		rs = append(rs, o.entries()...)
+	}
+	return fromIntervals(mergeRanges(rs))
+}
+
+// MergeAll is the union of all pools. It normalizes once after collecting every
+// entry, which is much cheaper than folding Union over a long slice.
+func MergeAll(pools []Megapool) Megapool {
+	n := 0
+	for _, p := range pools {
+		n += len(p.IPPool) + len(p.PrefixPool) + len(p.RangePool)
+	}
+	rs := make([]Range, 0, n)
+	for _, p := range pools {
+		rs = append(rs, p.entries()...)
+	}
+	return fromIntervals(mergeRanges(rs))
+}
+
+// Intersection returns a pool holding the addresses present in both m and
+// other.
+func (m *Megapool) Intersection(other Megapool) Megapool {
+	return fromIntervals(intersectRanges(m.intervals(), other.intervals()))
+}
+
+// Subtract returns a pool holding the addresses of m that are not in other.
+func (m *Megapool) Subtract(other Megapool) Megapool {
+	return fromIntervals(subtractRanges(m.intervals(), other.intervals()))
+}
+
+// Diff returns the addresses to add to and to remove from m to turn it into
+// target, i.e. target.Subtract(m) and m.Subtract(target).
+func (m *Megapool) Diff(target Megapool) (add Megapool, remove Megapool) {
+	return target.Subtract(*m), m.Subtract(target)
+}
+
+// ClampTo returns the part of the pool inside bound. Entries straddling the
+// boundary are cut and entries fully outside of it are dropped.
+func (m *Megapool) ClampTo(bound netip.Prefix) Megapool {
+	if !bound.IsValid() {
+		return Megapool{}
+	}
+	return fromIntervals(intersectRanges(m.intervals(), []Range{prefixRange(bound)}))
+}
+
+// ToPrefixes returns the minimal, sorted list of CIDR blocks covering exactly
+// the addresses of the pool. Overlapping and adjacent entries are aggregated.
+func (m *Megapool) ToPrefixes() []netip.Prefix {
+	var ps []netip.Prefix
+	for _, r := range m.intervals() {
+		ps = append(ps, r.AsPrefixes()...)
+	}
+	return ps
+}
+
+// ToPrefixesLimit is ToPrefixes, but fails without completing the
+// decomposition if it takes more than max prefixes.
+func (m *Megapool) ToPrefixesLimit(max int) ([]netip.Prefix, error) {
+	if max < 0 {
+		return nil, fmt.Errorf("negative prefix limit: %d", max)
+	}
+	var ps []netip.Prefix
+	for _, r := range m.intervals() {
+		var ok bool
+		if ps, ok = appendRangePrefixes(ps, r, max); !ok {
+			return nil, fmt.Errorf("pool takes more than %d prefixes", max)
+		}
+	}
+	return ps, nil
+}
+
+// PrefixCount returns the number of CIDR blocks ToPrefixes produces, i.e. the
+// cost of expressing the pool as routes.
+func (m *Megapool) PrefixCount() int {
+	n := 0
+	for _, r := range m.intervals() {
+		n += len(r.AsPrefixes())
+	}
+	return n
+}
+
+// PrefixLengthHistogram counts the entries of the pool by prefix length. IPs
+// count as /32 or /128 and ranges by the lengths of their CIDR decomposition.
+// Entries are not aggregated first, so the histogram shows how fragmented the
+// pool is as written.
+func (m *Megapool) PrefixLengthHistogram() map[int]int {
+	h := map[int]int{}
+	for _, v := range m.IPPool {
+		h[v.BitLen()]++
+	}
+	for _, v := range m.PrefixPool {
+		h[v.Bits()]++
+	}
+	for _, v := range m.RangePool {
+		for _, p := range v.AsPrefixes() {
+			h[p.Bits()]++
+		}
+	}
+	return h
+}
+
+// SnapRangesToCIDR returns a copy of the pool where every range is replaced by
+// the smallest prefix containing it, see Range.SnapToCIDR. This adds addresses
+// that were not in the original ranges.
+func (m *Megapool) SnapRangesToCIDR() Megapool {
+	s := Megapool{
+		IPPool:     slices.Clone(m.IPPool),
+		PrefixPool: slices.Clone(m.PrefixPool),
+	}
+	for _, v := range m.RangePool {
+		s.PrefixPool = append(s.PrefixPool, v.SnapToCIDR())
+	}
+	return s
+}
+
+// SplitSingletonsAndRanges merges the overlapping and adjacent entries of the
+// pool and returns, in ascending order, the addresses standing alone and the
+// ranges of two or more addresses. The ranges may span several last-octet
+// blocks.
+func (m *Megapool) SplitSingletonsAndRanges() ([]netip.Addr, []Range) {
+	var addrs []netip.Addr
+	var ranges []Range
+	for _, iv := range m.intervals() {
+		if iv.From == iv.To {
+			addrs = append(addrs, iv.From)
+		} else {
+			ranges = append(ranges, iv)
+		}
+	}
+	return addrs, ranges
+}
+
+// Min returns the lowest address of the pool, false if it is empty. IPv4
+// addresses are lower than IPv6 ones.
+func (m *Megapool) Min() (netip.Addr, bool) {
+	rs := m.entries()
+	if len(rs) == 0 {
+		return netip.Addr{}, false
+	}
+	lo := rs[0].From
+	for _, r := range rs[1:] {
+		lo = minAddr(lo, r.From)
+	}
+	return lo, true
+}
+
+// Max returns the highest address of the pool, false if it is empty.
+func (m *Megapool) Max() (netip.Addr, bool) {
+	rs := m.entries()
+	if len(rs) == 0 {
+		return netip.Addr{}, false
+	}
+	hi := rs[0].To
+	for _, r := range rs[1:] {
+		hi = maxAddr(hi, r.To)
 	}
-	return true
+	return hi, true
 }
 
-func parseRange(r string) (Range, error) {
-	items := strings.Split(r, "-")
-	if len(items) != 2 {
-		return Range{}, errors.New("not an accepted range")
+// EnclosingPrefix returns the smallest prefix containing every address of the
+// pool. It returns false for an empty pool or one mixing IPv4 and IPv6.
+func (m *Megapool) EnclosingPrefix() (netip.Prefix, bool) {
+	ivs := m.intervals()
+	if len(ivs) == 0 {
+		return netip.Prefix{}, false
 	}
+	lo, hi := ivs[0].From, ivs[len(ivs)-1].To
+	if lo.Is4() != hi.Is4() {
+		return netip.Prefix{}, false
+	}
+	return netip.PrefixFrom(lo, commonPrefixLen(lo, hi)).Masked(), true
+}
 
-	from, err := netip.ParseAddr(items[0])
-	if err != nil {
-		return Range{}, errors.New("not an accepted range")
+// AsSinglePrefix returns the CIDR block holding exactly the addresses of the
+// pool, in whatever entries, or false if there is none. A single IP is
+// returned as its /32 or /128.
+func (m *Megapool) AsSinglePrefix() (netip.Prefix, bool) {
+	ivs := m.intervals()
+	if len(ivs) != 1 {
+		return netip.Prefix{}, false
 	}
-	to, err := netip.ParseAddr(items[1])
-	if err != nil {
-		return Range{}, errors.New("not an accepted range")
+	iv := ivs[0]
+	p := netip.PrefixFrom(iv.From, commonPrefixLen(iv.From, iv.To)).Masked()
+	if prefixRange(p) != iv {
+		return netip.Prefix{}, false
 	}
-	fromSlice := from.AsSlice()
-	toSlice := to.AsSlice()
-	if len(fromSlice) == len(toSlice) {
-		for i := 0; i < len(fromSlice)-1; i++ {
-			if fromSlice[i] != toSlice[i] {
-				return Range{}, errors.New("not an accepted range")
-			}
-		}
-		if fromSlice[len(fromSlice)-1] >= toSlice[len(toSlice)-1] {
-			return Range{}, errors.New("not an accepted range")
-		}
-	} else {
-		return Range{}, errors.New("not an accepted range")
+	return p, true
+}
+
+// FitsInPrefixLen reports whether the whole pool lies within a single /bits
+// block. An empty pool always fits, one mixing IPv4 and IPv6 never does.
+func (m *Megapool) FitsInPrefixLen(bits int) bool {
+	if m.IsEmpty() {
+		return true
 	}
-	return Range{From: from, To: to}, nil
+	p, ok := m.EnclosingPrefix()
+	return ok && p.Bits() >= bits
 }
 
-func (m *Megapool) Overlaps(others ...Megapool) bool {
-	for _, o := range others {
-		for _, p1 := range m.PrefixPool {
-			for _, p2 := range o.PrefixPool {
-				if p1.Overlaps(p2) {
-					return true
-				}
-			}
+// Buckets splits the pool along the boundaries of /bits blocks, returning the
+// part of the pool within every block it touches, keyed by the block.
+// Addresses of a family for which bits is not a valid prefix length are
+// left out.
+func (m *Megapool) Buckets(bits int) map[netip.Prefix]Megapool {
+	parts := map[netip.Prefix][]Range{}
+	for _, iv := range m.intervals() {
+		for _, r := range iv.SplitByPrefixLen(bits) {
+			block := netip.PrefixFrom(r.From, bits).Masked()
+			parts[block] = append(parts[block], r)
 		}
-		for _, p1 := range m.PrefixPool {
-			for _, ip2 := range o.IPPool {
-				if p1.Contains(ip2) {
-					return true
+	}
+	buckets := make(map[netip.Prefix]Megapool, len(parts))
+	for block, rs := range parts {
+		buckets[block] = fromIntervals(rs)
+	}
+	return buckets
+}
+
+// Subnets yields every /bits child prefix of the pool entries, in pool
+// order, with IPs and ranges first expressed as prefixes. Entries narrower
+// than /bits, or of a family for which bits is not a valid prefix length,
+// are skipped.
+func (m *Megapool) Subnets(bits int) iter.Seq[netip.Prefix] {
+	entries := m.entries()
+	return func(yield func(netip.Prefix) bool) {
+		for _, r := range entries {
+			for _, p := range r.AsPrefixes() {
+				if p.Bits() > bits || bits > p.Addr().BitLen() {
+					continue
 				}
-			}
-		}
-		for _, p2 := range o.PrefixPool {
-			for _, ip1 := range m.IPPool {
-				if p2.Contains(ip1) {
-					return true
+				last := lastAddr(p)
+				for a := p.Addr(); a.IsValid() && a.Compare(last) <= 0; {
+					child := netip.PrefixFrom(a, bits)
+					if !yield(child) {
+						return
+					}
+					a = lastAddr(child).Next()
 				}
 			}
 		}
+	}
+}
 
-		for _, ip1 := range m.IPPool {
-			for _, ip2 := range o.IPPool {
-				if ip1 == ip2 {
-					return true
-				}
-			}
-		}
+// GapsWithin returns the ranges of parent not covered by the pool, in
+// ascending order.
+func (m *Megapool) GapsWithin(parent netip.Prefix) []Range {
+	if !parent.IsValid() {
+		return nil
+	}
+	return subtractRanges([]Range{prefixRange(parent)}, m.intervals())
+}
 
-		for _, p1 := range m.PrefixPool {
-			for _, r2 := range o.RangePool {
-				if p1.Contains(r2.From) || p1.Contains(r2.To) {
-					return true
-				}
-			}
-		}
-		for _, p2 := range o.PrefixPool {
-			for _, r1 := range m.RangePool {
-				if p2.Contains(r1.From) || p2.Contains(r1.To) {
-					return true
-				}
-			}
-		}
-		for _, r1 := range m.RangePool {
-			for _, ip2 := range o.IPPool {
-				if r1.From.Compare(ip2) <= 0 && r1.To.Compare(ip2) >= 0 {
-					return true
-				}
-			}
-		}
-		for _, r2 := range o.RangePool {
-			for _, ip1 := range m.IPPool {
-				if r2.From.Compare(ip1) <= 0 && r2.To.Compare(ip1) >= 0 {
-					return true
-				}
-			}
+// InternalGaps is GapsWithin the EnclosingPrefix of the pool. It returns nil
+// for an empty pool or one mixing IPv4 and IPv6.
+func (m *Megapool) InternalGaps() []Range {
+	p, ok := m.EnclosingPrefix()
+	if !ok {
+		return nil
+	}
+	return m.GapsWithin(p)
+}
+
+// CoverageBy returns the fraction of m's addresses that are also in other.
+// An empty pool has a coverage of 0.
+func (m *Megapool) CoverageBy(other Megapool) *big.Rat {
+	size := m.Size()
+	if size.Sign() == 0 {
+		return new(big.Rat)
+	}
+	in := m.Intersection(other)
+	return new(big.Rat).SetFrac(in.Size(), size)
+}
+
+// Jaccard returns the number of addresses in both pools divided by the
+// number of addresses in either, or 0 if both pools are empty.
+func (m *Megapool) Jaccard(other Megapool) *big.Rat {
+	in := m.OverlapSize(other)
+	union := new(big.Int).Add(m.Size(), other.Size())
+	union.Sub(union, in)
+	if union.Sign() == 0 {
+		return new(big.Rat)
+	}
+	return new(big.Rat).SetFrac(in, union)
+}
+
+// Overlap names two entries of a pool that share at least one address.
+type Overlap struct {
+	A string
+	B string
+}
+
+// HasInternalOverlap reports whether any two entries of the pool share an
+// address, e.g. a CIDR block containing one of the listed IPs.
+func (m *Megapool) HasInternalOverlap() bool {
+	rs := m.entries()
+	slices.SortFunc(rs, Range.Compare)
+	for i := 1; i < len(rs); i++ {
+		if rs[i].From.Compare(rs[i-1].To) <= 0 {
+			return true
 		}
-		for _, r1 := range m.RangePool {
-			for _, r2 := range o.RangePool {
-				if (r1.From.Compare(r2.From) <= 0 && r1.To.Compare(r2.From) >= 0) ||
-					(r1.From.Compare(r2.To) <= 0 && r1.To.Compare(r2.To) >= 0) {
-					return true
-				}
-			}
+		if rs[i].To.Compare(rs[i-1].To) < 0 {
+			rs[i].To = rs[i-1].To
 		}
 	}
 	return false
 }
 
-func (m *Megapool) HasMinSize(minSize int) bool {
-	min := float64(minSize)
-	actual := float64(len(m.IPPool))
-	if actual >= min {
-		return true
+// InternalOverlaps returns every pair of entries of the pool sharing an
+// address, in the order the entries are stored: IPs, then CIDR blocks, then
+// ranges.
+func (m *Megapool) InternalOverlaps() []Overlap {
+	rs := m.entries()
+	names := make([]string, 0, len(rs))
+	for _, v := range m.IPPool {
+		names = append(names, v.String())
 	}
 	for _, v := range m.PrefixPool {
-		actual += math.Pow(2, float64(32-v.Bits()))
-		if actual >= min {
-			return true
-		}
+		names = append(names, v.String())
 	}
 	for _, v := range m.RangePool {
-		from := v.From.AsSlice()
-		to := v.To.AsSlice()
-		if len(from) == 4 && len(to) == 4 {
-			actual += float64(to[3] - from[3] + 1)
-			if actual >= min {
-				return true
-			}
+		names = append(names, v.String())
+	}
+	order := make([]int, len(rs))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortStableFunc(order, func(i, j int) int {
+		return rs[i].Compare(rs[j])
+	})
+	var pairs [][2]int
+	var active []int
+	for _, i := range order {
+		active = slices.DeleteFunc(active, func(j int) bool {
+			return rs[j].To.Compare(rs[i].From) < 0
+		})
+		for _, j := range active {
+			pairs = append(pairs, [2]int{min(i, j), max(i, j)})
 		}
+		active = append(active, i)
 	}
-	return false
+	slices.SortFunc(pairs, func(a, b [2]int) int {
+		if a[0] != b[0] {
+			return a[0] - b[0]
+		}
+		return a[1] - b[1]
+	})
+	var overlaps []Overlap
+	for _, p := range pairs {
+		overlaps = append(overlaps, Overlap{A: names[p[0]], B: names[p[1]]})
+	}
+	return overlaps
 }
 
-func (m *Megapool) HasMaxSize(maxSize int) bool {
-	if maxSize == 0 {
-		return true
+// RemoveNested returns a copy of the pool without the entries fully covered by
+// another entry, such as 10.1.0.0/16 next to 10.0.0.0/8. Of entries covering
+// the same addresses, the first one is kept, IPs before CIDR blocks before
+// ranges. Unlike Normalize, adjacent and partially overlapping entries are
+// left alone.
+func (m *Megapool) RemoveNested() Megapool {
+	rs := m.entries()
+	order := make([]int, len(rs))
+	for i := range order {
+		order[i] = i
 	}
-	max := float64(maxSize)
-	actual := float64(len(m.IPPool))
-	if actual > max {
-		return false
+	slices.SortStableFunc(order, func(i, j int) int {
+		if c := rs[i].From.Compare(rs[j].From); c != 0 {
+			return c
+		}
+		return rs[j].To.Compare(rs[i].To)
+	})
+	nested := make([]bool, len(rs))
+	var reach netip.Addr
+	for _, i := range order {
+		if reach.IsValid() && rs[i].To.Compare(reach) <= 0 {
+			nested[i] = true
+			continue
+		}
+		reach = rs[i].To
 	}
-	for _, v := range m.PrefixPool {
-		actual += math.Pow(2, float64(32-v.Bits()))
-		if actual > max {
-			return false
+	var out Megapool
+	ips, prefixes := len(m.IPPool), len(m.PrefixPool)
+	for i, v := range m.IPPool {
+		if !nested[i] {
+			out.IPPool = append(out.IPPool, v)
+		}
+	}
+	for i, v := range m.PrefixPool {
+		if !nested[ips+i] {
+			out.PrefixPool = append(out.PrefixPool, v)
 		}
 	}
+	for i, v := range m.RangePool {
+		if !nested[ips+prefixes+i] {
+			out.RangePool = append(out.RangePool, v)
+		}
+	}
+	return out
+}
+
+// Duplicates returns the canonical form of every entry listed more than once,
+// followed by the IPs already covered by one of the listed prefixes or ranges.
+func (m *Megapool) Duplicates() []string {
+	var dups []string
+	seen := map[string]int{}
+	count := func(s string) {
+		seen[s]++
+		if seen[s] == 2 {
+			dups = append(dups, s)
+		}
+	}
+	for _, v := range m.IPPool {
+		count(v.String())
+	}
+	for _, v := range m.PrefixPool {
+		count(v.Masked().String())
+	}
 	for _, v := range m.RangePool {
-		from := v.From.AsSlice()
-		to := v.To.AsSlice()
-		if len(from) == 4 && len(to) == 4 {
-			actual += float64(to[3] - from[3] + 1)
-			if actual > max {
-				return false
-			}
+		count(v.String())
+	}
+	for _, v := range m.IPPool {
+		if seen[v.String()] > 1 {
+			continue
+		}
+		shadowed := slices.ContainsFunc(m.PrefixPool, func(p netip.Prefix) bool {
+			return p.Contains(v)
+		}) || slices.ContainsFunc(m.RangePool, func(r Range) bool {
+			return r.contains(v)
+		})
+		if shadowed {
+			dups = append(dups, v.String())
 		}
 	}
-	return actual <= max
+	return dups
 }
 
 func (m *Megapool) Equal(other Megapool) bool {
+	if len(m.IPPool) != len(other.IPPool) ||
+		len(m.PrefixPool) != len(other.PrefixPool) ||
+		len(m.RangePool) != len(other.RangePool) {
+		return false
+	}
 	var ips1 []string
 	var ips2 []string
 	for _, v := range m.IPPool {
@@ -282,22 +1771,507 @@ func (m *Megapool) Equal(other Megapool) bool {
 	return slices.Equal(ranges1, ranges2)
 }
 
+// EqualNormalized is a cheaper Equal for pools returned by Normalize with the
+// same representation. It compares the entries in order, so on other pools it
+// may report false for the same set of addresses.
+func (m *Megapool) EqualNormalized(other Megapool) bool {
+	return slices.Equal(m.IPPool, other.IPPool) &&
+		slices.Equal(m.PrefixPool, other.PrefixPool) &&
+		slices.EqualFunc(m.RangePool, other.RangePool, func(a, b Range) bool {
+			return a.Compare(b) == 0
+		})
+}
+
+// SplitByFamily partitions the pool into its IPv4 and IPv6 entries. Prefixes
+// are assigned by their address and ranges by their From address.
+func (m *Megapool) SplitByFamily() (v4 Megapool, v6 Megapool) {
+	for _, v := range m.IPPool {
+		if v.Is4() {
+			v4.IPPool = append(v4.IPPool, v)
+		} else {
+			v6.IPPool = append(v6.IPPool, v)
+		}
+	}
+	for _, v := range m.PrefixPool {
+		if v.Addr().Is4() {
+			v4.PrefixPool = append(v4.PrefixPool, v)
+		} else {
+			v6.PrefixPool = append(v6.PrefixPool, v)
+		}
+	}
+	for _, v := range m.RangePool {
+		if v.From.Is4() {
+			v4.RangePool = append(v4.RangePool, v)
+		} else {
+			v6.RangePool = append(v6.RangePool, v)
+		}
+	}
+	return v4, v6
+}
+
+// ShuffledAddrs yields every distinct address of the pool once, in a
+// pseudo-random order determined by seed. The order is computed on the fly
+// from a keyed permutation of the address indexes, so large ranges are not
+// materialized. Pools holding more than 2^63 addresses only shuffle their
+// lowest 2^63 addresses.
+func (m *Megapool) ShuffledAddrs(seed int64) iter.Seq[netip.Addr] {
+	ivs := m.intervals()
+	return func(yield func(netip.Addr) bool) {
+		limit := new(big.Int).Lsh(big.NewInt(1), 63)
+		starts := make([]uint64, len(ivs))
+		var n uint64
+		for i, r := range ivs {
+			starts[i] = n
+			size := r.size()
+			if left := new(big.Int).Sub(limit, new(big.Int).SetUint64(n)); size.Cmp(left) >= 0 {
+				n = limit.Uint64()
+				starts = starts[:i+1]
+				break
+			}
+			n += size.Uint64()
+		}
+		perm := newPermutation(n, seed)
+		for i := uint64(0); i < n; i++ {
+			idx := perm.at(i)
+			j := sort.Search(len(starts), func(j int) bool { return starts[j] > idx }) - 1
+			if !yield(addAddr(ivs[j].From, idx-starts[j])) {
+				return
+			}
+		}
+	}
+}
+
+// AddrsStride yields every step-th distinct address of the pool, in ascending
+// order, starting with the lowest one. The stride carries over from one range
+// to the next. It yields nothing for a step below 1.
+func (m *Megapool) AddrsStride(step int) iter.Seq[netip.Addr] {
+	ivs := m.intervals()
+	return func(yield func(netip.Addr) bool) {
+		if step < 1 {
+			return
+		}
+		n := big.NewInt(int64(step))
+		// skip is the number of addresses to pass over before the next yield.
+		var skip uint64
+		for _, r := range ivs {
+			if size := r.size(); size.Cmp(new(big.Int).SetUint64(skip)) <= 0 {
+				skip -= size.Uint64()
+				continue
+			}
+			for a := addAddr(r.From, skip); ; a = addAddr(a, uint64(step)) {
+				if !yield(a) {
+					return
+				}
+				if left := new(big.Int).Sub(addrToInt(r.To), addrToInt(a)); left.Cmp(n) < 0 {
+					skip = uint64(step) - left.Uint64() - 1
+					break
+				}
+			}
+		}
+	}
+}
+
+// Walk calls onAddr, onPrefix and onRange for every IP, prefix and range of the
+// pool, each category in ascending order. nil callbacks are skipped.
+func (m *Megapool) Walk(onAddr func(netip.Addr), onPrefix func(netip.Prefix), onRange func(Range)) {
+	s := m.sorted()
+	if onAddr != nil {
+		for _, v := range s.IPPool {
+			onAddr(v)
+		}
+	}
+	if onPrefix != nil {
+		for _, v := range s.PrefixPool {
+			onPrefix(v)
+		}
+	}
+	if onRange != nil {
+		for _, v := range s.RangePool {
+			onRange(v)
+		}
+	}
+}
+
+// logSampleSize is the number of entries LogValue lists.
+const logSampleSize = 5
+
+// LogValue implements slog.LogValuer. It logs the pool as a group of entry
+// counts, the number of distinct addresses and the first few entries, rather
+// than every entry.
+func (m Megapool) LogValue() slog.Value {
+	sample := make([]string, 0, logSampleSize)
+	for _, v := range m.IPPool {
+		if len(sample) == cap(sample) {
+			break
+		}
+		sample = append(sample, v.String())
+	}
+	for _, v := range m.PrefixPool {
+		if len(sample) == cap(sample) {
+			break
+		}
+		sample = append(sample, v.String())
+	}
+	for _, v := range m.RangePool {
+		if len(sample) == cap(sample) {
+			break
+		}
+		sample = append(sample, v.String())
+	}
+	return slog.GroupValue(
+		slog.Int("ips", len(m.IPPool)),
+		slog.Int("cidrs", len(m.PrefixPool)),
+		slog.Int("ranges", len(m.RangePool)),
+		slog.String("size", m.Size().String()),
+		slog.String("sample", strings.Join(sample, ",")),
+	)
+}
+
+// CanonicalString is the String of Normalize(AsIs): pools holding the same
+// addresses, however they are written, share it, which makes it suitable for
+// diffing and hashing.
+func (m *Megapool) CanonicalString() string {
+	n := m.Normalize(AsIs)
+	return n.String()
+}
+
 func (m *Megapool) String() string {
 	return strings.Join(m.AsSlice(), ",")
 }
 
+// AsSlice returns the string form of every entry: IPs, then CIDR blocks, then
+// ranges. Each category is sorted, IPs by address, CIDR blocks by network then
+// length and ranges with Range.Compare, so that pools listing the same entries
+// in any order print the same.
 func (m *Megapool) AsSlice() []string {
+	n := m.Len()
+	if n == 0 {
+		return nil
+	}
+	sorted := m.sorted()
+	// Format every entry into one buffer and slice the result, costing two
+	// allocations instead of one per entry.
+	buf := make([]byte, 0, n*len("255.255.255.255/32"))
+	ends := make([]int, 0, n)
+	for _, v := range sorted.IPPool {
+		buf = v.AppendTo(buf)
+		ends = append(ends, len(buf))
+	}
+	for _, v := range sorted.PrefixPool {
+		buf = v.AppendTo(buf)
+		ends = append(ends, len(buf))
+	}
+	for _, v := range sorted.RangePool {
+		buf = v.From.AppendTo(buf)
+		buf = append(buf, '-')
+		buf = v.To.AppendTo(buf)
+		ends = append(ends, len(buf))
+	}
+	all := string(buf)
+	s := make([]string, n)
+	start := 0
+	for i, end := range ends {
+		s[i] = all[start:end]
+		start = end
+	}
+	return s
+}
+
+// Entries returns copies of the IPs, CIDR blocks and ranges of the pool, the
+// typed counterpart of AsSlice. Changing them does not change the pool.
+func (m *Megapool) Entries() ([]netip.Addr, []netip.Prefix, []Range) {
+	c := m.clone()
+	return c.IPPool, c.PrefixPool, c.RangePool
+}
+
+// AsSliceOrdered is AsSlice with the categories in the given order, named
+// "ip", "cidr" and "range", e.g. []string{"cidr", "range", "ip"} to list IPs
+// last. Categories missing from order are left out, unknown and repeated
+// names are ignored.
+func (m *Megapool) AsSliceOrdered(order []string) []string {
+	all := m.AsSlice()
+	ips, prefixes := len(m.IPPool), len(m.PrefixPool)
+	groups := map[string][]string{
+		"ip":    all[:ips],
+		"cidr":  all[ips : ips+prefixes],
+		"range": all[ips+prefixes:],
+	}
 	var s []string
+	for _, name := range order {
+		s = append(s, groups[name]...)
+		delete(groups, name)
+	}
+	return s
+}
+
+// WriteTo writes the entries of the pool to w separated by commas, as String
+// would return them, without building the whole string. Labels of a
+// TaggedMegapool are not written.
+func (m *Megapool) WriteTo(w io.Writer) (int64, error) {
+	return m.WriteSeparated(w, ",")
+}
+
+// WriteSeparated is WriteTo with entries separated by sep.
+func (m *Megapool) WriteSeparated(w io.Writer, sep string) (int64, error) {
+	const flushSize = 4096
+	sorted := m.sorted()
+	buf := make([]byte, 0, flushSize+128)
+	var written int64
+	var err error
+	first := true
+	// next starts a new entry, first sending the buffer to w once it is full.
+	next := func() bool {
+		if len(buf) >= flushSize {
+			n, werr := w.Write(buf)
+			written += int64(n)
+			buf, err = buf[:0], werr
+		}
+		if !first {
+			buf = append(buf, sep...)
+		}
+		first = false
+		return err == nil
+	}
+	for _, v := range sorted.IPPool {
+		if !next() {
+			return written, err
+		}
+		buf = v.AppendTo(buf)
+	}
+	for _, v := range sorted.PrefixPool {
+		if !next() {
+			return written, err
+		}
+		buf = v.AppendTo(buf)
+	}
+	for _, v := range sorted.RangePool {
+		if !next() {
+			return written, err
+		}
+		buf = v.From.AppendTo(buf)
+		buf = append(buf, '-')
+		buf = v.To.AppendTo(buf)
+	}
+	if len(buf) > 0 {
+		n, err := w.Write(buf)
+		written += int64(n)
+		return written, err
+	}
+	return written, nil
+}
+
+// AsIPSet returns the pool one entry per line in a form accepted by ipset
+// hash:net sets: IPs as /32 or /128 blocks, CIDR blocks masked to their network
+// address and ranges as ip1-ip2.
+func (m *Megapool) AsIPSet() string {
+	var sb strings.Builder
 	for _, v := range m.IPPool {
-		s = append(s, v.String())
+		sb.WriteString(netip.PrefixFrom(v, v.BitLen()).String() + "\n")
 	}
 	for _, v := range m.PrefixPool {
-		s = append(s, v.String())
+		sb.WriteString(v.Masked().String() + "\n")
 	}
 	for _, v := range m.RangePool {
-		s = append(s, v.String())
+		sb.WriteString(v.String() + "\n")
 	}
-	return s
+	return sb.String()
+}
+
+// TreeString renders the CIDR blocks of the pool as a tree, one per line,
+// with every block indented under the closest block containing it. IPs count
+// as /32 or /128 blocks and ranges as their CIDR decomposition. Entries are
+// not aggregated so that nested ones stay visible.
+func (m *Megapool) TreeString() string {
+	var ps []netip.Prefix
+	for _, v := range m.IPPool {
+		ps = append(ps, netip.PrefixFrom(v, v.BitLen()))
+	}
+	for _, v := range m.PrefixPool {
+		ps = append(ps, v.Masked())
+	}
+	for _, v := range m.RangePool {
+		ps = append(ps, v.AsPrefixes()...)
+	}
+	slices.SortFunc(ps, comparePrefix)
+	ps = slices.Compact(ps)
+	var sb strings.Builder
+	var parents []netip.Prefix
+	for _, p := range ps {
+		for len(parents) > 0 {
+			top := parents[len(parents)-1]
+			if top.Bits() <= p.Bits() && top.Contains(p.Addr()) {
+				break
+			}
+			parents = parents[:len(parents)-1]
+		}
+		sb.WriteString(strings.Repeat("  ", len(parents)) + p.String() + "\n")
+		parents = append(parents, p)
+	}
+	return sb.String()
+}
+
+// FromPrefixHostCount returns a pool holding the first n usable host addresses
+// of p. For IPv4 prefixes up to /30 the network and broadcast addresses are
+// not usable, for /31, /32 and IPv6 prefixes every address is.
+func FromPrefixHostCount(p netip.Prefix, n int) (Megapool, error) {
+	if !p.IsValid() {
+		return Megapool{}, errors.New("not a cidr block")
+	}
+	if n <= 0 {
+		return Megapool{}, fmt.Errorf("not an accepted host count: value=%v", n)
+	}
+	hosts := hostRange(p)
+	lo, hi := hosts.AsBigIntRange()
+	last := new(big.Int).Add(lo, big.NewInt(int64(n-1)))
+	if last.Cmp(hi) > 0 {
+		return Megapool{}, fmt.Errorf("not enough hosts in cidr block: value=%v, requested=%v, available=%v", p, n, hosts.size())
+	}
+	to, _ := intToAddr(last, p.Addr().Is6())
+	return fromIntervals([]Range{{From: hosts.From, To: to}}), nil
+}
+
+// UsableHosts returns a copy of the pool without the network and broadcast
+// addresses of its IPv4 prefixes up to /30. /31 and /32 prefixes are kept
+// whole as per RFC 3021, as are IPv6 prefixes, IPs and ranges.
+func (m *Megapool) UsableHosts() Megapool {
+	u := Megapool{
+		IPPool:    slices.Clone(m.IPPool),
+		RangePool: slices.Clone(m.RangePool),
+	}
+	for _, v := range m.PrefixPool {
+		if !v.Addr().Is4() || v.Bits() > 30 {
+			u.PrefixPool = append(u.PrefixPool, v)
+			continue
+		}
+		hosts := fromIntervals([]Range{hostRange(v)})
+		u.IPPool = append(u.IPPool, hosts.IPPool...)
+		u.PrefixPool = append(u.PrefixPool, hosts.PrefixPool...)
+		u.RangePool = append(u.RangePool, hosts.RangePool...)
+	}
+	return u
+}
+
+// Dilate grows every entry of the pool to the /bits blocks it touches, e.g.
+// each /24 to its /16 or each IP to its /31 pair, and returns the result in
+// the form of Normalize(AsIs). Dilating adds addresses: the result holds the
+// whole pool and its neighbours within the blocks. Entries already wider than
+// /bits, and those of a family for which bits is not a valid prefix length,
+// are kept as they are.
+func (m *Megapool) Dilate(bits int) Megapool {
+	rs := m.entries()
+	for i, r := range rs {
+		if bits < 0 || bits > r.From.BitLen() {
+			continue
+		}
+		from := netip.PrefixFrom(r.From, bits).Masked().Addr()
+		to := lastAddr(netip.PrefixFrom(r.To, bits))
+		rs[i] = Range{From: from, To: to}
+	}
+	return fromIntervals(mergeRanges(rs))
+}
+
+// QuantizeToPow2 replaces every entry of the pool with the smallest CIDR
+// block covering it and returns the result in the form of Normalize(AsIs).
+// This over-allocates: 1.1.1.0-1.1.1.99 becomes the 128 addresses of
+// 1.1.1.0/25, and a range straddling a block boundary, such as
+// 1.1.1.100-1.1.1.199, the whole 1.1.1.0/24.
+func (m *Megapool) QuantizeToPow2() Megapool {
+	rs := m.entries()
+	for i, r := range rs {
+		rs[i] = prefixRange(netip.PrefixFrom(r.From, commonPrefixLen(r.From, r.To)))
+	}
+	return fromIntervals(mergeRanges(rs))
+}
+
+// WithNetworkAddrs returns a copy of the pool with the first and last address,
+// i.e. the network and broadcast addresses, of every /bits block it touches
+// added as IPs where missing. Addresses of a family for which bits is not a
+// valid prefix length are left alone.
+func (m *Megapool) WithNetworkAddrs(bits int) Megapool {
+	out := Megapool{
+		IPPool:     slices.Clone(m.IPPool),
+		PrefixPool: slices.Clone(m.PrefixPool),
+		RangePool:  slices.Clone(m.RangePool),
+	}
+	ivs := m.intervals()
+	var prev netip.Prefix
+	for _, iv := range ivs {
+		for _, r := range iv.SplitByPrefixLen(bits) {
+			block := netip.PrefixFrom(r.From, bits).Masked()
+			if block == prev {
+				continue
+			}
+			prev = block
+			for _, a := range []netip.Addr{block.Addr(), lastAddr(block)} {
+				if !searchRanges(ivs, a) {
+					out.IPPool = append(out.IPPool, a)
+				}
+			}
+		}
+	}
+	return out
+}
+
+// hostRange returns the usable host addresses of p: for IPv4 prefixes up to
+// /30 all but the network and broadcast addresses, for others every address.
+func hostRange(p netip.Prefix) Range {
+	hosts := prefixRange(p)
+	if p.Addr().Is4() && p.Bits() <= 30 {
+		hosts = Range{From: hosts.From.Next(), To: hosts.To.Prev()}
+	}
+	return hosts
+}
+
+// ToIPNets converts the pool to net.IPNet values. IPs become /32 or /128
+// networks and ranges are decomposed into CIDR blocks.
+func (m *Megapool) ToIPNets() []net.IPNet {
+	var nets []net.IPNet
+	for _, v := range m.IPPool {
+		nets = append(nets, toIPNet(netip.PrefixFrom(v, v.BitLen())))
+	}
+	for _, v := range m.PrefixPool {
+		nets = append(nets, toIPNet(v))
+	}
+	for _, v := range m.RangePool {
+		for _, p := range v.AsPrefixes() {
+			nets = append(nets, toIPNet(p))
+		}
+	}
+	return nets
+}
+
+func toIPNet(p netip.Prefix) net.IPNet {
+	p = p.Masked()
+	return net.IPNet{
+		IP:   net.IP(p.Addr().AsSlice()),
+		Mask: net.CIDRMask(p.Bits(), p.Addr().BitLen()),
+	}
+}
+
+// FromIPNets builds a pool from net.IPNet values, the reverse of ToIPNets.
+// Single address networks become IPs and invalid networks are skipped. The
+// family is taken from the mask length, so a v4 network stored with a 16 byte
+// IP stays v4.
+func FromIPNets(nets []net.IPNet) Megapool {
+	var m Megapool
+	for _, n := range nets {
+		ones, bits := n.Mask.Size()
+		ip := n.IP
+		if bits == 32 {
+			ip = ip.To4()
+		}
+		a, ok := netip.AddrFromSlice(ip)
+		if !ok || bits != a.BitLen() {
+			continue
+		}
+		p := unmapPrefix(netip.PrefixFrom(a, ones))
+		if p.IsSingleIP() {
+			m.IPPool = append(m.IPPool, p.Addr())
+			continue
+		}
+		m.PrefixPool = append(m.PrefixPool, p)
+	}
+	return m
 }
 
 func (r *Range) String() string {
@@ -1,8 +1,20 @@
 package megapool
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"math"
+	"math/big"
+	"math/rand"
+	"net"
 	"net/netip"
+	"runtime"
 	"slices"
+	"strings"
 	"testing"
 )
 
@@ -148,6 +160,52 @@ func TestNewMegapool(t *testing.T) {
 				nil,
 			},
 			false,
+		}, {
+			"v4-mapped IP, CIDR and range",
+			args{"::ffff:8.8.8.8,::ffff:1.0.0.0/104,::ffff:1.1.1.1-::ffff:1.1.1.10"},
+			Megapool{
+				[]netip.Addr{a("8.8.8.8")},
+				[]netip.Prefix{p("1.0.0.0/8")},
+				[]Range{{From: a("1.1.1.1"), To: a("1.1.1.10")}},
+			},
+			false,
+		}, {
+			"v4-mapped short CIDR kept as v6",
+			args{"::ffff:0.0.0.0/95"},
+			Megapool{
+				nil,
+				[]netip.Prefix{p("::ffff:0.0.0.0/95")},
+				nil,
+			},
+			false,
+		}, {
+			"wrong range v4 to v6",
+			args{"1.1.1.1-2001:db8::1"},
+			Megapool{nil, nil, nil},
+			true,
+		}, {
+			"wrong range v6 to v4",
+			args{"2001:db8::1-1.1.1.10"},
+			Megapool{nil, nil, nil},
+			true,
+		}, {
+			"range v4-mapped to plain v4",
+			args{"::ffff:1.1.1.1-1.1.1.10"},
+			Megapool{
+				nil,
+				nil,
+				[]Range{{From: a("1.1.1.1"), To: a("1.1.1.10")}},
+			},
+			false,
+		}, {
+			"range plain v6",
+			args{"2001:db8::1-2001:db8::ff"},
+			Megapool{
+				nil,
+				nil,
+				[]Range{{From: a("2001:db8::1"), To: a("2001:db8::ff")}},
+			},
+			false,
 		}, {
 			"mixed separators and unordered and spaces and tabs",
 			args{"8.8.8.8,8.8.8.7;1.0.0.0/8, 2.0.0.0/8;		3.0.0.0/8"},
@@ -205,12 +263,39 @@ func TestMegapool_Overlaps(t *testing.T) {
 		{"only CIDRs and ranges and overlapping", "1.1.1.0/24", "1.1.1.1-1.1.1.10", true},
 		{"only CIDRs and ranges and overlapping", "1.1.1.1-1.1.1.10", "1.0.0.0/8", true},
 		{"only CIDRs and ranges and overlapping", "1.1.1.1-1.1.1.10", "1.1.1.0/24", true},
+		{"v4-mapped IP and v4 CIDR overlapping", "::ffff:1.2.3.4", "1.2.3.0/24", true},
+		{"v4 default route and IP", "0.0.0.0/0", "255.255.255.255", true},
+		{"v4 default route and range", "1.1.1.1-1.1.1.10", "0.0.0.0/0", true},
+		{"v4 default route and v6", "0.0.0.0/0", "2001:db8::/32", false},
+		{"v6 default route and IP", "::/0", "2001:db8::1", true},
+		{"v6 default route and v4", "::/0", "1.1.1.0/24", false},
+		{"v4-mapped CIDR and v4 IP overlapping", "1.2.3.4", "::ffff:1.2.3.0/120", true},
+		{"v4-mapped range and v4 CIDR overlapping", "::ffff:1.2.3.4-::ffff:1.2.3.10", "1.2.3.0/24", true},
 		{"mixed and overlapping IP left and unordered", "3.3.3.255,2.0.0.0/8,1.0.0.0/8,10.10.10.10-10.10.10.17", "4.0.0.0/8,3.0.0.0/8", true},
 		{"mixed and overlapping IP left and unordered", "3.3.3.255,2.0.0.0/8,1.0.0.0/8,10.10.10.10-10.10.10.17", "4.0.0.0/8,3.3.3.250-3.3.3.255", true},
 		{"mixed and overlapping IP right and unordered", "2.0.0.0/8,1.0.0.0/8", "1.1.1.255,4.0.0.0/8,3.0.0.0/8", true},
 		{"mixed and overlapping IP right and unordered", "2.0.0.0/8,1.1.1.250-1.1.1.255", "1.1.1.255,4.0.0.0/8,3.0.0.0/8", true},
 		{"mixed and overlapping IP right and left and unordered", "5.5.5.5,2.0.0.0/8,1.0.0.0/8", "5.5.5.5,4.0.0.0/8,3.0.0.0/8", true},
 		{"mixed and not overlapping", "5.5.5.5,2.0.0.0/8,1.0.0.0/8,6.6.6.1-6.6.6.5", "6.6.6.6,4.0.0.0/8,3.0.0.0/8,5.5.5.1-5.5.5.2", false},
+		{"/32 equal to a range start", "1.1.1.2/32", "1.1.1.2-1.1.1.10", true},
+		{"/32 equal to a range end", "1.1.1.10/32", "1.1.1.2-1.1.1.10", true},
+		{"/32 strictly inside a range", "1.1.1.5/32", "1.1.1.2-1.1.1.10", true},
+		{"range around a /32", "1.1.1.2-1.1.1.10", "1.1.1.5/32", true},
+		{"/32 just before a range", "1.1.1.1/32", "1.1.1.2-1.1.1.10", false},
+		{"/32 just after a range", "1.1.1.11/32", "1.1.1.2-1.1.1.10", false},
+		{"/31 strictly inside a range", "1.1.1.4/31", "1.1.1.2-1.1.1.10", true},
+		{"/31 sharing a range start", "1.1.1.0/31", "1.1.1.1-1.1.1.10", true},
+		{"/31 sharing a range end", "1.1.1.10/31", "1.1.1.2-1.1.1.10", true},
+		{"/31 just before a range", "1.1.1.0/31", "1.1.1.2-1.1.1.10", false},
+		{"/31 just after a range", "1.1.1.12/31", "1.1.1.2-1.1.1.11", false},
+		{"range inside another range", "1.1.1.5-1.1.1.6", "1.1.1.2-1.1.1.10", true},
+		{"/32 and its IP", "1.1.1.5/32", "1.1.1.5", true},
+		{"/32 and another IP", "1.1.1.5/32", "1.1.1.4", false},
+		{"/31 and its first IP", "1.1.1.4/31", "1.1.1.4", true},
+		{"/31 and its last IP", "1.1.1.4/31", "1.1.1.5", true},
+		{"/31 and the next IP", "1.1.1.4/31", "1.1.1.6", false},
+		{"/32 inside a /31", "1.1.1.5/32", "1.1.1.4/31", true},
+		{"adjacent /31s", "1.1.1.4/31", "1.1.1.6/31", false},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -223,145 +308,3386 @@ func TestMegapool_Overlaps(t *testing.T) {
 	}
 }
 
-func TestMegapool_HasMinSize(t *testing.T) {
+func TestMegapool_IsAdjacentTo(t *testing.T) {
+	tests := []struct {
+		name  string
+		main  string
+		other string
+		want  bool
+	}{
+		{"abutting prefixes", "1.1.1.0/24", "1.1.2.0/24", true},
+		{"abutting the other way", "1.1.2.0/24", "1.1.1.0/24", true},
+		{"abutting IP and range", "1.1.1.1-1.1.1.9", "1.1.1.10", true},
+		{"abutting mixed pools", "1.1.0.0/24,1.1.1.0-1.1.1.100", "1.1.1.101,1.1.2.0/24", true},
+		{"overlapping", "1.1.1.0/24", "1.1.1.255,1.1.2.0/24", false},
+		{"gapped", "1.1.1.0/24", "1.1.2.1", false},
+		{"equal", "1.1.1.0/24", "1.1.1.0/24", false},
+		{"empty", "", "1.1.1.0/24", false},
+		{"both empty", "", "", false},
+		{"across families", "255.255.255.255", "::", false},
+		{"v6", "2001:db8::/64", "2001:db8:0:1::/64", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			other, _ := NewMegapool(tt.other)
+			if got := m.IsAdjacentTo(other); got != tt.want {
+				t.Errorf("Megapool.IsAdjacentTo() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMegapool_OverlapSize(t *testing.T) {
+	tests := []struct {
+		name  string
+		main  string
+		other string
+		want  string
+	}{
+		{"empty", "", "1.1.1.0/24", "0"},
+		{"disjoint", "1.1.1.0/24", "1.1.2.0/24", "0"},
+		{"partial", "1.1.1.0/24", "1.1.1.250-1.1.1.255,1.1.2.0/24", "6"},
+		{"full containment", "1.1.1.0/24", "1.1.0.0/16", "256"},
+		{"overlapping entries counted once", "1.1.1.0/24,1.1.1.1-1.1.1.10", "1.1.1.5,1.1.1.0/28", "16"},
+		{"v6", "2001:db8::/64", "2001:db8::/48", "18446744073709551616"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			other, _ := NewMegapool(tt.other)
+			if got := m.OverlapSize(other).String(); got != tt.want {
+				t.Errorf("Megapool.OverlapSize() = %v, want %v", got, tt.want)
+			}
+			in := m.Intersection(other)
+			if got := in.Size().String(); got != tt.want {
+				t.Errorf("Megapool.Intersection().Size() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMegapool_Overlaps_PointRange(t *testing.T) {
+	tests := []struct {
+		name  string
+		point string
+		other string
+		want  bool
+	}{
+		{"equal to an IP", "1.1.1.1", "1.1.1.1", true},
+		{"next to an IP", "1.1.1.1", "1.1.1.2", false},
+		{"inside a prefix", "1.1.1.1", "1.1.1.0/24", true},
+		{"first address of a prefix", "1.1.1.0", "1.1.1.0/24", true},
+		{"last address of a prefix", "1.1.1.255", "1.1.1.0/24", true},
+		{"just outside a prefix", "1.1.2.0", "1.1.1.0/24", false},
+		{"at the start of a range", "1.1.1.2", "1.1.1.2-1.1.1.10", true},
+		{"at the end of a range", "1.1.1.10", "1.1.1.2-1.1.1.10", true},
+		{"just before a range", "1.1.1.1", "1.1.1.2-1.1.1.10", false},
+		{"just after a range", "1.1.1.11", "1.1.1.2-1.1.1.10", false},
+		{"equal point range", "1.1.1.1", "", true},
+		{"ipv6 inside a prefix", "2001:db8::1", "2001:db8::/64", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := netip.MustParseAddr(tt.point)
+			point := Megapool{RangePool: []Range{{From: a, To: a}}}
+			ip := Megapool{IPPool: []netip.Addr{a}}
+			other, _ := NewMegapool(tt.other)
+			if tt.other == "" {
+				other = point
+			}
+			if got := point.Overlaps(other); got != tt.want {
+				t.Errorf("Megapool.Overlaps() = %v, want %v", got, tt.want)
+			}
+			if got := other.Overlaps(point); got != tt.want {
+				t.Errorf("Megapool.Overlaps() reversed = %v, want %v", got, tt.want)
+			}
+			if got := ip.Overlaps(other); got != tt.want {
+				t.Errorf("Megapool.Overlaps() with a bare IP = %v, want %v", got, tt.want)
+			}
+			if got, want := point.OverlapSize(other), ip.OverlapSize(other); got.Cmp(want) != 0 {
+				t.Errorf("Megapool.OverlapSize() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestMegapool_OverlapsExcept(t *testing.T) {
+	tests := []struct {
+		name   string
+		main   string
+		args   string
+		except string
+		want   bool
+	}{
+		{"no exception", "1.1.1.0/24", "1.1.1.255", "", true},
+		{"only overlap is the exception", "1.1.1.0/24", "1.1.1.255,1.1.2.0/24", "1.1.1.255", false},
+		{"overlap inside a larger exception", "1.1.1.0/24", "1.1.1.200-1.1.1.210", "1.1.1.128/25", false},
+		{"additional overlap", "1.1.1.0/24", "1.1.1.255,1.1.1.1", "1.1.1.255", true},
+		{"exception elsewhere", "1.1.1.0/24", "1.1.1.1", "1.1.2.0/24", true},
+		{"disjoint", "1.1.1.0/24", "1.1.2.0/24", "1.1.1.255", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			other, _ := NewMegapool(tt.args)
+			except, _ := NewMegapool(tt.except)
+			if got := m.OverlapsExcept(other, except); got != tt.want {
+				t.Errorf("Megapool.OverlapsExcept() = %v, want %v", got, tt.want)
+			}
+			a, b := m.Subtract(except), other.Subtract(except)
+			if got := a.Overlaps(b); got != tt.want {
+				t.Errorf("Megapool.Subtract().Overlaps() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMegapool_OverlapsAny(t *testing.T) {
+	var candidates []Megapool
+	for _, v := range []string{"1.1.1.0/24", "", "1.1.2.1-1.1.2.10", "1.1.3.0/24,1.1.2.5", "1.1.2.0/24"} {
+		c, _ := NewMegapool(v)
+		candidates = append(candidates, c)
+	}
+	tests := []struct {
+		name   string
+		main   string
+		want   int
+		wantOk bool
+	}{
+		{"hit", "1.1.3.100,1.1.4.1", 3, true},
+		{"first hit", "1.1.2.8", 2, true},
+		{"miss", "1.1.4.0/24", -1, false},
+		{"empty", "", -1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			got, ok := m.OverlapsAny(context.Background(), candidates)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("Megapool.OverlapsAny() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestMegapool_OverlapsAny_Cancel(t *testing.T) {
+	m, _ := NewMegapool("1.1.1.1")
+	candidates := []Megapool{m}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if got, ok := m.OverlapsAny(ctx, candidates); got != -1 || ok {
+		t.Errorf("Megapool.OverlapsAny() = %v, %v, want %v, %v", got, ok, -1, false)
+	}
+}
+
+func TestMegapool_OverlapsCtx(t *testing.T) {
 	tests := []struct {
 		name string
 		main string
-		args int
+		args string
 		want bool
 	}{
-		{"empty", "", 1, false},
-		{"only 3 IPs", "1.1.1.1,1.1.1.3,1.1.1.3", 2, true},
-		{"only 3 IPs", "1.1.1.1,1.1.1.3,1.1.1.3", 3, true},
-		{"only 3 IPs", "1.1.1.1,1.1.1.3,1.1.1.3", 4, false},
-		{"only CIDRs", "1.1.1.1/32", 2, false},
-		{"only CIDRs", "1.1.1.1/32,1.2.1.1/30", 10, false},
-		{"only CIDRs", "1.1.1.1/32,1.2.1.1/29", 10, false},
-		{"only CIDRs", "1.1.1.1/32,1.2.1.1/28", 10, true},
-		{"only CIDRs", "1.1.1.1/32,1.2.1.1/28", 17, true},
-		{"only CIDRs", "1.1.1.1/32,1.2.1.1/28", 18, false},
-		{"only CIDRs", "1.1.1.1/32,1.2.1.1/24", 257, true},
-		{"only CIDRs", "1.1.1.1/32,1.2.1.1/24", 258, false},
-		{"only CIDRs", "1.1.1.1/32,1.2.1.1/16", 65537, true},
-		{"only CIDRs", "1.1.1.1/32,1.2.1.1/16", 65538, false},
-		{"only CIDRs", "1.1.1.1/32,1.2.1.1/8", 16777217, true},
-		{"only CIDRs", "1.1.1.1/32,1.2.1.1/8", 16777218, false},
-		{"only ranges and less", "1.1.1.1-1.1.1.10", 9, true},
-		{"only ranges and equal", "1.1.1.1-1.1.1.10", 10, true},
-		{"only ranges too much", "1.1.1.1-1.1.1.10", 11, false},
-		{"mixed IPs and CIDRs", "1.1.1.1,1.1.1.2,1.2.1.1/24,1.3.1.1/24", 514, true},
-		{"mixed IPs and CIDRs", "1.1.1.1,1.1.1.2,1.2.1.1/24,1.3.1.1/24", 515, false},
+		{"empty", "", "", false},
+		{"overlapping", "1.1.1.0/24", "2.2.2.2,1.1.1.5", true},
+		{"not overlapping", "1.1.1.0/24", "2.2.2.2,1.1.2.5", false},
+		{"large and overlapping at the end", largeInput(5000), "10.19.135.25", true},
+		{"large and not overlapping", largeInput(5000), "10.19.135.31", false},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			m, _ := NewMegapool(tt.main)
-			if got := m.HasMinSize(tt.args); got != tt.want {
-				t.Errorf("Megapool.HasMinSize() = %v, want %v", got, tt.want)
+			other, _ := NewMegapool(tt.args)
+			got, err := m.OverlapsCtx(context.Background(), other)
+			if err != nil || got != tt.want {
+				t.Errorf("Megapool.OverlapsCtx() = %v, %v, want %v, nil", got, err, tt.want)
 			}
 		})
 	}
 }
 
-func TestMegapool_HasMaxSize(t *testing.T) {
+func TestMegapool_OverlapsCtx_Cancel(t *testing.T) {
+	m, _ := NewMegapool(largeInput(5000))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if got, err := m.OverlapsCtx(ctx, m); got || !errors.Is(err, context.Canceled) {
+		t.Errorf("Megapool.OverlapsCtx() = %v, %v, want false, %v", got, err, context.Canceled)
+	}
+	if _, err := overlapRangesCtx(ctx, m.intervals(), m.intervals()); !errors.Is(err, context.Canceled) {
+		t.Errorf("overlapRangesCtx() error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestMegapool_OverlapsString(t *testing.T) {
+	tests := []struct {
+		name    string
+		main    string
+		args    string
+		want    bool
+		wantErr bool
+	}{
+		{"overlapping", "1.1.1.0/24", "2.2.2.2,1.1.1.5", true, false},
+		{"not overlapping", "1.1.1.0/24", "2.2.2.2,1.1.2.5", false, false},
+		{"empty string", "1.1.1.0/24", "", false, false},
+		{"invalid string", "1.1.1.0/24", "1.1.1.5,1.1.1", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			got, err := m.OverlapsString(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Megapool.OverlapsString() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("Megapool.OverlapsString() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMegapool_ContainsPrefix(t *testing.T) {
 	tests := []struct {
 		name string
 		main string
-		args int
+		args string
 		want bool
 	}{
-		{"empty", "", 0, true},
-		{"only 3 IPs", "1.1.1.1,1.1.1.3,1.1.1.3", 2, false},
-		{"only 3 IPs", "1.1.1.1,1.1.1.3,1.1.1.3", 3, true},
-		{"only 3 IPs", "1.1.1.1,1.1.1.3,1.1.1.3", 4, true},
-		{"only CIDRs /24", "1.1.1.1/24", 256, true},
-		{"only CIDRs /32", "1.1.1.1/32", 2, true},
-		{"only CIDRs", "1.1.1.1/32,1.2.1.1/30", 4, false},
-		{"only CIDRs", "1.1.1.1/32,1.2.1.1/30", 5, true},
-		{"only CIDRs", "1.1.1.1/32,1.2.1.1/30", 10, true},
-		{"only ranges", "1.1.1.1-1.1.1.10", 9, false},
-		{"only ranges", "1.1.1.1-1.1.1.10", 10, true},
-		{"only ranges", "1.1.1.1-1.1.1.10", 11, true},
-		{"only ranges and less", "1.1.1.0-1.1.1.10", 10, false},
-		{"only ranges and equal", "1.1.1.0-1.1.1.10", 11, true},
-		{"only ranges too much", "1.1.1.0-1.1.1.10", 12, true},
-		{"mixed and less", "1.1.1.1,1.1.1.11-1.1.1.15,1.2.1.0/24", 261, false},
-		{"mixed and match", "1.1.1.1,1.1.1.11-1.1.1.15,1.2.1.0/24", 262, true},
-		{"mixed and more", "1.1.1.1,1.1.1.11-1.1.1.15,1.2.1.0/24", 263, true},
+		{"empty pool", "", "1.1.1.0/24", false},
+		{"same prefix", "1.1.1.0/24", "1.1.1.0/24", true},
+		{"subnet", "1.1.0.0/16", "1.1.1.0/24", true},
+		{"supernet", "1.1.1.0/24", "1.1.0.0/16", false},
+		{"covered by several entries", "1.1.1.0/25,1.1.1.128-1.1.1.255", "1.1.1.0/24", true},
+		{"partially covered", "1.1.1.0/25,1.1.1.129-1.1.1.255", "1.1.1.0/24", false},
+		{"single address", "1.1.1.1", "1.1.1.1/32", true},
+		{"unmasked", "1.1.1.0/24", "1.1.1.7/25", true},
+		{"v4-mapped", "1.1.1.0/24", "::ffff:1.1.1.0/120", true},
+		{"ipv6", "2001:db8::/32", "2001:db8:1::/48", true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			m, _ := NewMegapool(tt.main)
-			if got := m.HasMaxSize(tt.args); got != tt.want {
-				t.Errorf("Megapool.HasMaxSize() = %v, want %v", got, tt.want)
+			if got := m.ContainsPrefix(netip.MustParsePrefix(tt.args)); got != tt.want {
+				t.Errorf("Megapool.ContainsPrefix() = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
 
-func TestMegapool_HasOnlyIPv4(t *testing.T) {
+func TestMegapool_AllowsCIDR(t *testing.T) {
+	tests := []struct {
+		name    string
+		main    string
+		args    string
+		want    bool
+		wantErr bool
+	}{
+		{"fully contained subnet", "10.0.0.0/8,192.168.0.0/16", "10.20.0.0/16", true, false},
+		{"partially overlapping", "10.0.0.0/16", "10.0.0.0/15", false, false},
+		{"disjoint", "10.0.0.0/16", "11.0.0.0/16", false, false},
+		{"surrounding spaces", "10.0.0.0/8", " 10.1.0.0/16 ", true, false},
+		{"invalid string", "10.0.0.0/8", "10.0.0.0/33", false, true},
+		{"not a cidr", "10.0.0.0/8", "10.0.0.1", false, true},
+		{"empty string", "10.0.0.0/8", "", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			got, err := m.AllowsCIDR(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Megapool.AllowsCIDR() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("Megapool.AllowsCIDR() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMegapool_Overlaps_Empty(t *testing.T) {
+	tests := []string{"", "1.1.1.1", "0.0.0.0/0", "::/0", "1.1.1.1-1.1.1.10", "1.1.1.1,::/0,1.1.1.1-1.1.1.10"}
+	empty := Megapool{}
+	for _, tt := range tests {
+		t.Run(tt, func(t *testing.T) {
+			m, _ := NewMegapool(tt)
+			if got := empty.Overlaps(m); got {
+				t.Errorf("Megapool.Overlaps() = %v, want %v", got, false)
+			}
+			if got := m.Overlaps(empty); got {
+				t.Errorf("Megapool.Overlaps() = %v, want %v", got, false)
+			}
+			if got := m.Overlaps(empty, m); got != !m.IsEmpty() {
+				t.Errorf("Megapool.Overlaps() = %v, want %v", got, !m.IsEmpty())
+			}
+		})
+	}
+}
+
+func BenchmarkMegapool_Overlaps_Empty(b *testing.B) {
+	m, _ := NewMegapool(largeInput(1000))
+	empty := Megapool{}
+	b.Run("empty receiver", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			empty.Overlaps(m)
+		}
+	})
+	b.Run("empty other", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			m.Overlaps(empty)
+		}
+	})
+}
+
+// naiveOverlaps compares every entry of m with every entry of other.
+func naiveOverlaps(m, other Megapool) bool {
+	for _, a := range m.entries() {
+		for _, b := range other.entries() {
+			if a.From.Compare(b.To) <= 0 && b.From.Compare(a.To) <= 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func randomPrefixes(rng *rand.Rand, n int) Megapool {
+	var m Megapool
+	for i := 0; i < n; i++ {
+		a := netip.AddrFrom4([4]byte{10, 0, byte(rng.Intn(256)), byte(rng.Intn(256))})
+		m.PrefixPool = append(m.PrefixPool, netip.PrefixFrom(a, 16+rng.Intn(17)).Masked())
+	}
+	return m
+}
+
+func TestMegapool_Overlaps_Naive(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	hits := 0
+	for i := 0; i < 2000; i++ {
+		m, other := randomPrefixes(rng, 1+rng.Intn(4)), randomPrefixes(rng, 1+rng.Intn(4))
+		want := naiveOverlaps(m, other)
+		if got := m.Overlaps(other); got != want {
+			t.Fatalf("Megapool.Overlaps(%v) on %v = %v, want %v", other.String(), m.String(), got, want)
+		}
+		if want {
+			hits++
+		}
+	}
+	if hits == 0 || hits == 2000 {
+		t.Errorf("naiveOverlaps() = true for %d of 2000 samples, want a mix", hits)
+	}
+}
+
+// interleavedPrefixes returns n /24 blocks of 10.0.0.0/8, every other block
+// starting at the given one.
+func interleavedPrefixes(n, first int) Megapool {
+	var m Megapool
+	for i := 0; i < n; i++ {
+		b := first + 2*i
+		m.PrefixPool = append(m.PrefixPool, netip.PrefixFrom(netip.AddrFrom4([4]byte{10, byte(b >> 8), byte(b), 0}), 24))
+	}
+	return m
+}
+
+func BenchmarkMegapool_Overlaps_Prefixes(b *testing.B) {
+	m, other := interleavedPrefixes(5000, 0), interleavedPrefixes(5000, 1)
+	b.Run("sweep", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			m.Overlaps(other)
+		}
+	})
+	b.Run("naive", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			naiveOverlaps(m, other)
+		}
+	})
+}
+
+func TestMegapool_IsEmpty(t *testing.T) {
 	tests := []struct {
 		name string
 		main string
 		want bool
 	}{
-		{"empty", "", false},
-		{"only v4 ips", "1.1.1.1, 1.1.1.2", true},
-		{"only v4 cidrs", "1.1.1.1/32, 1.1.1.0/24", true},
-		{"only v4 ranges", "1.1.1.1-1.1.1.10", true},
-		{"only v4 but mixed", "1.1.1.1, 1.1.1.0/24, 1.1.1.1-1.1.1.10", true},
-		{"ips v4 and v6", "1.1.1.1, 2345:0425:2CA1:0000:0000:0567:5673:23b5", false},
-		{"v4 and v6 cidrs", "1.1.1.1/32, 2001:db8:1234::/48", false},
+		{"empty", "", true},
+		{"spaces", "  ", true},
+		{"IP", "1.1.1.1", false},
+		{"CIDR", "1.1.1.0/24", false},
+		{"range", "1.1.1.1-1.1.1.10", false},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			m, _ := NewMegapool(tt.main)
-			if got := m.HasOnlyIPv4(); got != tt.want {
-				t.Errorf("Megapool.HasOnlyIPv4() = %v, want %v", got, tt.want)
+			if got := m.IsEmpty(); got != tt.want {
+				t.Errorf("Megapool.IsEmpty() = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
 
-func TestMegapool_AsSlice(t *testing.T) {
+func TestMegapool_Equal(t *testing.T) {
 	tests := []struct {
 		name string
+		main string
 		args string
-		want []string
+		want bool
 	}{
-		{"empty", "", nil},
-		{
-			"shuffled",
-			"1.1.1.1,1.1.1.5-1.1.1.10,1.1.1.2,2.2.2.0/24,1.1.1.20-1.1.1.25,2.2.3.0/24",
-			[]string{"1.1.1.1", "1.1.1.2", "2.2.2.0/24", "2.2.3.0/24", "1.1.1.5-1.1.1.10", "1.1.1.20-1.1.1.25"},
-		},
-		{
-			"shuffled some more",
-			"2.2.2.0/24,1.1.1.5-1.1.1.10,1.1.1.1,1.1.1.20-1.1.1.25,2.2.3.0/24,1.1.1.2,",
-			[]string{"1.1.1.1", "1.1.1.2", "2.2.2.0/24", "2.2.3.0/24", "1.1.1.5-1.1.1.10", "1.1.1.20-1.1.1.25"},
-		},
+		{"empty", "", "", true},
+		{"same order", "1.1.1.1,1.1.1.0/24,1.1.1.1-1.1.1.10", "1.1.1.1,1.1.1.0/24,1.1.1.1-1.1.1.10", true},
+		{"shuffled", "1.1.1.1,2.2.2.2,1.1.1.0/24,1.1.2.0/24", "1.1.2.0/24,2.2.2.2,1.1.1.0/24,1.1.1.1", true},
+		{"different IP count", "1.1.1.1,2.2.2.2", "1.1.1.1", false},
+		{"different CIDR count", "1.1.1.0/24", "1.1.1.0/24,1.1.2.0/24", false},
+		{"different range count", "1.1.1.1-1.1.1.10", "", false},
+		{"duplicates matter", "1.1.1.1,1.1.1.1", "1.1.1.1,2.2.2.2", false},
+		{"same counts different entries", "1.1.1.1,1.1.1.0/24", "1.1.1.2,1.1.1.0/24", false},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			m, _ := NewMegapool(tt.args)
-			if got := m.AsSlice(); !slices.Equal(got, tt.want) {
-				t.Errorf("Megapool.AsSlice() = %v, want %v", got, tt.want)
+			m, _ := NewMegapool(tt.main)
+			other, _ := NewMegapool(tt.args)
+			if got := m.Equal(other); got != tt.want {
+				t.Errorf("Megapool.Equal() = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
 
-func p(s string) netip.Prefix {
-	p, err := netip.ParsePrefix(s)
-	if err != nil {
-		panic(err)
-	}
-	return p
+func BenchmarkMegapool_Equal(b *testing.B) {
+	m, _ := NewMegapool(largeInput(1000))
+	b.Run("different counts", func(b *testing.B) {
+		other, _ := NewMegapool(largeInput(999))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			m.Equal(other)
+		}
+	})
+	b.Run("same counts", func(b *testing.B) {
+		other, _ := NewMegapool(largeInput(1000))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			m.Equal(other)
+		}
+	})
 }
 
-func a(s string) netip.Addr {
-	a, err := netip.ParseAddr(s)
-	if err != nil {
-		panic(err)
+func TestMegapool_Contains(t *testing.T) {
+	tests := []struct {
+		name string
+		main string
+		args netip.Addr
+		want bool
+	}{
+		{"empty", "", a("1.1.1.1"), false},
+		{"IP", "1.1.1.1", a("1.1.1.1"), true},
+		{"other IP", "1.1.1.1", a("1.1.1.2"), false},
+		{"CIDR", "1.1.1.0/24", a("1.1.1.255"), true},
+		{"outside CIDR", "1.1.1.0/24", a("1.1.2.0"), false},
+		{"range start", "1.1.1.5-1.1.1.10", a("1.1.1.5"), true},
+		{"range end", "1.1.1.5-1.1.1.10", a("1.1.1.10"), true},
+		{"outside range", "1.1.1.5-1.1.1.10", a("1.1.1.11"), false},
+		{"v4-mapped address", "1.1.1.0/24", a("::ffff:1.1.1.1"), true},
+		{"v6", "2001:db8::/32", a("2001:db8::1"), true},
+		{"invalid address", "0.0.0.0/0", netip.Addr{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			if got := m.Contains(tt.args); got != tt.want {
+				t.Errorf("Megapool.Contains() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMegapool_Locate(t *testing.T) {
+	tests := []struct {
+		name   string
+		main   string
+		addr   string
+		want   string
+		wantOk bool
+	}{
+		{"empty", "", "1.1.1.1", "", false},
+		{"not contained", "1.1.1.0/24", "1.1.2.1", "", false},
+		{"ip", "1.1.1.1,1.1.1.0/24", "1.1.1.1", "1.1.1.1", true},
+		{"prefix", "1.1.1.1,1.1.1.0/24", "1.1.1.2", "1.1.1.0/24", true},
+		{"range", "1.1.1.10-1.1.1.20", "1.1.1.15", "1.1.1.10-1.1.1.20", true},
+		{"range narrower than prefix", "1.1.1.0/24,1.1.1.10-1.1.1.20", "1.1.1.15", "1.1.1.10-1.1.1.20", true},
+		{"prefix narrower than range", "1.1.1.0-1.1.1.200,1.1.1.0/26", "1.1.1.15", "1.1.1.0/26", true},
+		{"nested prefixes", "1.1.0.0/16,1.1.1.0/24,1.0.0.0/8", "1.1.1.1", "1.1.1.0/24", true},
+		{"mapped address", "1.1.1.0/24", "::ffff:1.1.1.1", "1.1.1.0/24", true},
+		{"ipv6", "2001:db8::/32,2001:db8::/64", "2001:db8::1", "2001:db8::/64", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			got, ok := m.Locate(netip.MustParseAddr(tt.addr))
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("Megapool.Locate() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestMegapool_CompileMembership(t *testing.T) {
+	tests := []struct {
+		name string
+		main string
+	}{
+		{"empty", ""},
+		{"bitmap", "10.0.0.1,10.0.1.0/24,10.0.2.10-10.0.2.20,10.0.3.255,10.0.4.0/30"},
+		{"bitmap up to the last address", "255.255.255.0/25,255.255.255.255"},
+		{"bitmap from the first address", "0.0.0.0,0.0.0.5-0.0.0.9"},
+		{"v4 too wide for a bitmap", "10.0.0.0/8,200.0.0.1,200.0.0.5-200.0.0.9"},
+		{"v6", "2001:db8::/120,2001:db8::1:1,2001:db8::2:5-2001:db8::2:9"},
+		{"mixed family", "10.0.0.0/30,2001:db8::/126,::ffff:10.0.1.1"},
+	}
+	rnd := rand.New(rand.NewSource(1))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			contains := m.CompileMembership()
+			var samples []netip.Addr
+			for _, r := range m.entries() {
+				samples = append(samples, r.From, r.From.Prev(), r.To, r.To.Next())
+				lo, hi := r.AsBigIntRange()
+				for i := 0; i < 20; i++ {
+					n := new(big.Int).Sub(hi, lo)
+					n.Add(n, big.NewInt(32))
+					n.Rand(rnd, n)
+					n.Add(n, lo)
+					n.Sub(n, big.NewInt(16))
+					if addr, ok := intToAddr(n, r.From.Is6()); ok {
+						samples = append(samples, addr)
+					}
+				}
+			}
+			samples = append(samples, a("1.1.1.1"), a("::1"), a("::ffff:10.0.0.1"), netip.Addr{})
+			for _, addr := range samples {
+				if got, want := contains(addr), m.Contains(addr); got != want {
+					t.Errorf("Megapool.CompileMembership()(%v) = %v, want %v", addr, got, want)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkMegapool_CompileMembership(b *testing.B) {
+	m, _ := NewMegapool(largeInput(1000))
+	addr := a("10.3.231.25")
+	b.Run("Contains", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			m.Contains(addr)
+		}
+	})
+	b.Run("bitmap", func(b *testing.B) {
+		contains := m.CompileMembership()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			contains(addr)
+		}
+	})
+	m.PrefixPool = append(m.PrefixPool, p("200.0.0.0/8"))
+	b.Run("intervals", func(b *testing.B) {
+		contains := m.CompileMembership()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			contains(addr)
+		}
+	})
+}
+
+func TestMegapool_Len(t *testing.T) {
+	tests := []struct {
+		name string
+		main string
+		want int
+	}{
+		{"empty", "", 0},
+		{"duplicates counted", "1.1.1.1,1.1.1.1", 2},
+		{"mixed", "1.1.1.1,1.0.0.0/8,1.1.1.1-1.1.1.10", 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			if got := m.Len(); got != tt.want {
+				t.Errorf("Megapool.Len() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMegapool_Summary(t *testing.T) {
+	tests := []struct {
+		name string
+		main string
+		want string
+	}{
+		{"empty", "", "0 IPs, 0 CIDRs, 0 ranges, 0 addresses total"},
+		{"mixed", "2.2.2.1,2.2.2.2,2.2.2.3,1.1.1.0/24,1.1.2.0/23,1.1.5.1-1.1.5.3", "3 IPs, 2 CIDRs, 1 range, 774 addresses total"},
+		{"singular", "2.2.2.1,1.1.1.0/24,1.1.5.1-1.1.5.4", "1 IP, 1 CIDR, 1 range, 261 addresses total"},
+		{"overlaps counted once", "1.1.1.1,1.1.1.0/24,1.1.1.1-1.1.1.4,1.1.1.2-1.1.1.3", "1 IP, 1 CIDR, 2 ranges, 256 addresses total"},
+		{"whole v4 space", "0.0.0.0/0", "0 IPs, 1 CIDR, 0 ranges, 4294967296 addresses total"},
+		{"huge v6", "2001:db8::/64", "0 IPs, 1 CIDR, 0 ranges, ~1.8e19 addresses total"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			if got := m.Summary(); got != tt.want {
+				t.Errorf("Megapool.Summary() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMegapool_Relation(t *testing.T) {
+	tests := []struct {
+		name string
+		main string
+		args string
+		want Relation
+	}{
+		{"both empty", "", "", RelEqual},
+		{"empty and non-empty", "", "1.1.1.1", RelDisjoint},
+		{"non-empty and empty", "1.1.1.1", "", RelDisjoint},
+		{"disjoint", "1.1.1.0/24", "1.1.2.0/24", RelDisjoint},
+		{"adjacent", "1.1.1.0/25", "1.1.1.128/25", RelDisjoint},
+		{"intersects", "1.1.1.0-1.1.1.100", "1.1.1.50-1.1.1.150", RelIntersects},
+		{"contains", "1.1.0.0/16", "1.1.1.0/24,1.1.2.1", RelContains},
+		{"contained by", "1.1.1.1,1.1.1.5", "1.1.1.0/24", RelContainedBy},
+		{"equal", "1.1.1.0/24", "1.1.1.0/24", RelEqual},
+		{"equal in different forms", "1.1.1.0/24,1.1.1.7", "1.1.1.0-1.1.1.127,1.1.1.128/25", RelEqual},
+		{"dual-stack intersects", "1.1.1.1,2001:db8::1", "2001:db8::/64,3.3.3.3", RelIntersects},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			other, _ := NewMegapool(tt.args)
+			if got := m.Relation(other); got != tt.want {
+				t.Errorf("Megapool.Relation() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMegapool_HasMinSize(t *testing.T) {
+	tests := []struct {
+		name string
+		main string
+		args int
+		want bool
+	}{
+		{"empty", "", 1, false},
+		{"only 3 IPs", "1.1.1.1,1.1.1.3,1.1.1.3", 2, true},
+		{"only 3 IPs", "1.1.1.1,1.1.1.3,1.1.1.3", 3, true},
+		{"only 3 IPs", "1.1.1.1,1.1.1.3,1.1.1.3", 4, false},
+		{"only CIDRs", "1.1.1.1/32", 2, false},
+		{"only CIDRs", "1.1.1.1/32,1.2.1.1/30", 10, false},
+		{"only CIDRs", "1.1.1.1/32,1.2.1.1/29", 10, false},
+		{"only CIDRs", "1.1.1.1/32,1.2.1.1/28", 10, true},
+		{"only CIDRs", "1.1.1.1/32,1.2.1.1/28", 17, true},
+		{"only CIDRs", "1.1.1.1/32,1.2.1.1/28", 18, false},
+		{"only CIDRs", "1.1.1.1/32,1.2.1.1/24", 257, true},
+		{"only CIDRs", "1.1.1.1/32,1.2.1.1/24", 258, false},
+		{"only CIDRs", "1.1.1.1/32,1.2.1.1/16", 65537, true},
+		{"only CIDRs", "1.1.1.1/32,1.2.1.1/16", 65538, false},
+		{"only CIDRs", "1.1.1.1/32,1.2.1.1/8", 16777217, true},
+		{"only CIDRs", "1.1.1.1/32,1.2.1.1/8", 16777218, false},
+		{"only ranges and less", "1.1.1.1-1.1.1.10", 9, true},
+		{"only ranges and equal", "1.1.1.1-1.1.1.10", 10, true},
+		{"only ranges too much", "1.1.1.1-1.1.1.10", 11, false},
+		{"mixed IPs and CIDRs", "1.1.1.1,1.1.1.2,1.2.1.1/24,1.3.1.1/24", 514, true},
+		{"mixed IPs and CIDRs", "1.1.1.1,1.1.1.2,1.2.1.1/24,1.3.1.1/24", 515, false},
+		{"v4-mapped CIDR is v4 sized", "::ffff:1.2.3.0/120", 256, true},
+		{"v4-mapped CIDR is v4 sized", "::ffff:1.2.3.0/120", 257, false},
+		{"v4 default route", "0.0.0.0/0", 1 << 32, true},
+		{"v4 default route too much", "0.0.0.0/0", 1<<32 + 1, false},
+		{"v6 default route", "::/0", math.MaxInt, true},
+		{"v6 ranges", "2001:db8::1-2001:db8::10", 16, true},
+		{"v6 ranges too much", "2001:db8::1-2001:db8::10", 17, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			if got := m.HasMinSize(tt.args); got != tt.want {
+				t.Errorf("Megapool.HasMinSize() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMegapool_HasMaxSize(t *testing.T) {
+	tests := []struct {
+		name string
+		main string
+		args int
+		want bool
+	}{
+		{"empty", "", 0, true},
+		{"empty unbounded", "", Unbounded, true},
+		{"max 0 addresses", "1.1.1.1", 0, false},
+		{"max 0 addresses and CIDR", "1.1.1.0/24", 0, false},
+		{"no maximum", "1.1.1.1", Unbounded, true},
+		{"no maximum and CIDR", "1.0.0.0/8", Unbounded, true},
+		{"empty and negative", "", -2, false},
+		{"negative", "1.1.1.1", -2, false},
+		{"only 3 IPs", "1.1.1.1,1.1.1.3,1.1.1.3", 2, false},
+		{"only 3 IPs", "1.1.1.1,1.1.1.3,1.1.1.3", 3, true},
+		{"only 3 IPs", "1.1.1.1,1.1.1.3,1.1.1.3", 4, true},
+		{"only CIDRs /24", "1.1.1.1/24", 256, true},
+		{"only CIDRs /32", "1.1.1.1/32", 2, true},
+		{"only CIDRs", "1.1.1.1/32,1.2.1.1/30", 4, false},
+		{"only CIDRs", "1.1.1.1/32,1.2.1.1/30", 5, true},
+		{"only CIDRs", "1.1.1.1/32,1.2.1.1/30", 10, true},
+		{"only ranges", "1.1.1.1-1.1.1.10", 9, false},
+		{"only ranges", "1.1.1.1-1.1.1.10", 10, true},
+		{"only ranges", "1.1.1.1-1.1.1.10", 11, true},
+		{"only ranges and less", "1.1.1.0-1.1.1.10", 10, false},
+		{"only ranges and equal", "1.1.1.0-1.1.1.10", 11, true},
+		{"only ranges too much", "1.1.1.0-1.1.1.10", 12, true},
+		{"mixed and less", "1.1.1.1,1.1.1.11-1.1.1.15,1.2.1.0/24", 261, false},
+		{"mixed and match", "1.1.1.1,1.1.1.11-1.1.1.15,1.2.1.0/24", 262, true},
+		{"mixed and more", "1.1.1.1,1.1.1.11-1.1.1.15,1.2.1.0/24", 263, true},
+		{"v4 default route and less", "0.0.0.0/0", 1<<32 - 1, false},
+		{"v4 default route and equal", "0.0.0.0/0", 1 << 32, true},
+		{"v6 default route", "::/0", math.MaxInt, false},
+		{"v6 ranges and less", "2001:db8::1-2001:db8::10", 15, false},
+		{"v6 ranges and equal", "2001:db8::1-2001:db8::10", 16, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			if got := m.HasMaxSize(tt.args); got != tt.want {
+				t.Errorf("Megapool.HasMaxSize() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMegapool_HasOnlyIPv4(t *testing.T) {
+	tests := []struct {
+		name string
+		main string
+		want bool
+	}{
+		{"empty", "", false},
+		{"only v4 ips", "1.1.1.1, 1.1.1.2", true},
+		{"only v4 cidrs", "1.1.1.1/32, 1.1.1.0/24", true},
+		{"only v4 ranges", "1.1.1.1-1.1.1.10", true},
+		{"only v4 but mixed", "1.1.1.1, 1.1.1.0/24, 1.1.1.1-1.1.1.10", true},
+		{"ips v4 and v6", "1.1.1.1, 2345:0425:2CA1:0000:0000:0567:5673:23b5", false},
+		{"v4 and v6 cidrs", "1.1.1.1/32, 2001:db8:1234::/48", false},
+		{"v4-mapped", "::ffff:1.1.1.1, ::ffff:1.1.1.0/120, ::ffff:1.1.1.1-::ffff:1.1.1.10", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			if got := m.HasOnlyIPv4(); got != tt.want {
+				t.Errorf("Megapool.HasOnlyIPv4() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func BenchmarkMegapool_AsSlice(b *testing.B) {
+	m, err := NewMegapool(largeInput(20000))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.AsSlice()
+	}
+}
+
+func TestMegapool_Entries(t *testing.T) {
+	m, _ := NewMegapool("2.2.2.2,1.1.1.5-1.1.1.10,10.0.0.0/8,1.1.1.1")
+	ips, prefixes, ranges := m.Entries()
+	if want := []netip.Addr{a("2.2.2.2"), a("1.1.1.1")}; !slices.Equal(ips, want) {
+		t.Errorf("Megapool.Entries() ips = %v, want %v", ips, want)
+	}
+	if want := []netip.Prefix{p("10.0.0.0/8")}; !slices.Equal(prefixes, want) {
+		t.Errorf("Megapool.Entries() prefixes = %v, want %v", prefixes, want)
+	}
+	if want := []Range{r("1.1.1.5-1.1.1.10")}; !slices.Equal(ranges, want) {
+		t.Errorf("Megapool.Entries() ranges = %v, want %v", ranges, want)
+	}
+	ips[0] = a("9.9.9.9")
+	prefixes[0] = p("9.0.0.0/8")
+	ranges[0].To = a("1.1.1.200")
+	_ = append(ips[:1], a("8.8.8.8"))
+	if got, want := m.String(), "1.1.1.1,2.2.2.2,10.0.0.0/8,1.1.1.5-1.1.1.10"; got != want {
+		t.Errorf("Megapool.Entries() aliases the pool, pool = %v, want %v", got, want)
+	}
+
+	var empty Megapool
+	if ips, prefixes, ranges := empty.Entries(); ips != nil || prefixes != nil || ranges != nil {
+		t.Errorf("Megapool.Entries() = %v, %v, %v, want nil slices", ips, prefixes, ranges)
+	}
+}
+
+func TestMegapool_AsSliceOrdered(t *testing.T) {
+	const main = "1.1.1.5-1.1.1.10,2.2.2.2,10.0.0.0/8,1.1.1.1,1.0.0.0/8"
+	tests := []struct {
+		name  string
+		main  string
+		order []string
+		want  []string
+	}{
+		{"empty", "", []string{"ip", "cidr", "range"}, nil},
+		{"default order", main, []string{"ip", "cidr", "range"}, []string{"1.1.1.1", "2.2.2.2", "1.0.0.0/8", "10.0.0.0/8", "1.1.1.5-1.1.1.10"}},
+		{"ips last", main, []string{"cidr", "range", "ip"}, []string{"1.0.0.0/8", "10.0.0.0/8", "1.1.1.5-1.1.1.10", "1.1.1.1", "2.2.2.2"}},
+		{"ranges first", main, []string{"range", "ip", "cidr"}, []string{"1.1.1.5-1.1.1.10", "1.1.1.1", "2.2.2.2", "1.0.0.0/8", "10.0.0.0/8"}},
+		{"missing category", main, []string{"cidr", "ip"}, []string{"1.0.0.0/8", "10.0.0.0/8", "1.1.1.1", "2.2.2.2"}},
+		{"unknown and repeated names", main, []string{"range", "host", "range"}, []string{"1.1.1.5-1.1.1.10"}},
+		{"no order", main, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			if got := m.AsSliceOrdered(tt.order); !slices.Equal(got, tt.want) {
+				t.Errorf("Megapool.AsSliceOrdered() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMegapool_AsSlice(t *testing.T) {
+	tests := []struct {
+		name string
+		args string
+		want []string
+	}{
+		{"empty", "", nil},
+		{
+			"shuffled",
+			"1.1.1.1,1.1.1.5-1.1.1.10,1.1.1.2,2.2.2.0/24,1.1.1.20-1.1.1.25,2.2.3.0/24",
+			[]string{"1.1.1.1", "1.1.1.2", "2.2.2.0/24", "2.2.3.0/24", "1.1.1.5-1.1.1.10", "1.1.1.20-1.1.1.25"},
+		},
+		{
+			"deterministic order",
+			"1.1.1.20-1.1.1.25,2.2.3.0/24,1.1.1.2,1.1.1.5-1.1.1.10,2.2.2.0/24,1.1.1.1",
+			[]string{"1.1.1.1", "1.1.1.2", "2.2.2.0/24", "2.2.3.0/24", "1.1.1.5-1.1.1.10", "1.1.1.20-1.1.1.25"},
+		},
+		{
+			"prefixes by network then length",
+			"10.0.0.0/16,1.0.0.0/8,10.0.0.0/8,1.0.0.0/16",
+			[]string{"1.0.0.0/8", "1.0.0.0/16", "10.0.0.0/8", "10.0.0.0/16"},
+		},
+		{
+			"ranges by start then end",
+			"1.1.1.5-1.1.1.20,1.1.1.1-1.1.1.9,1.1.1.5-1.1.1.10",
+			[]string{"1.1.1.1-1.1.1.9", "1.1.1.5-1.1.1.10", "1.1.1.5-1.1.1.20"},
+		},
+		{
+			"shuffled some more",
+			"2.2.2.0/24,1.1.1.5-1.1.1.10,1.1.1.1,1.1.1.20-1.1.1.25,2.2.3.0/24,1.1.1.2,",
+			[]string{"1.1.1.1", "1.1.1.2", "2.2.2.0/24", "2.2.3.0/24", "1.1.1.5-1.1.1.10", "1.1.1.20-1.1.1.25"},
+		},
+		{
+			"ipv6",
+			"2001:db8::1-2001:db8::ff,2001:db8::/32,fe80::1%eth0,2001:db8::ffff:1.1.1.1",
+			[]string{"2001:db8::ffff:101:101", "fe80::1%eth0", "2001:db8::/32", "2001:db8::1-2001:db8::ff"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.args)
+			if got := m.AsSlice(); !slices.Equal(got, tt.want) {
+				t.Errorf("Megapool.AsSlice() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMegapool_PercentOfIPv4(t *testing.T) {
+	tests := []struct {
+		name string
+		main string
+		want float64
+	}{
+		{"empty", "", 0},
+		{"v6 only", "2001:db8::/32", 0},
+		{"/24", "1.1.1.0/24", 100.0 / (1 << 24)},
+		{"/8", "10.0.0.0/8", 0.390625},
+		{"overlaps counted once", "10.0.0.0/8,10.1.0.0/16,2001:db8::/32", 0.390625},
+		{"whole space", "0.0.0.0/1,128.0.0.0/1", 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			if got := m.PercentOfIPv4(); got != tt.want {
+				t.Errorf("Megapool.PercentOfIPv4() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMegapool_HasAtLeastPrefixLen(t *testing.T) {
+	tests := []struct {
+		name string
+		main string
+		bits int
+		want bool
+	}{
+		{"empty", "", 32, false},
+		{"/24 is at least a /26", "1.1.1.0/24", 26, true},
+		{"/24 is at least a /24", "1.1.1.0/24", 24, true},
+		{"/24 is not a /23", "1.1.1.0/24", 23, false},
+		{"overlaps counted once", "1.1.1.0/24,1.1.1.0/25", 23, false},
+		{"two /24s make a /23", "1.1.1.0/24,1.1.2.0/24", 23, true},
+		{"single IP is a /32", "1.1.1.1", 32, true},
+		{"v6 /64 is at least a /96", "2001:db8::/64", 96, true},
+		{"v6 /64 is not a /63", "2001:db8::/64", 63, false},
+		{"negative bits", "1.1.1.0/24", -1, false},
+		{"bits beyond v4", "1.1.1.0/24", 33, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			if got := m.HasAtLeastPrefixLen(tt.bits); got != tt.want {
+				t.Errorf("Megapool.HasAtLeastPrefixLen() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMegapool_Size(t *testing.T) {
+	tests := []struct {
+		name string
+		main string
+		want string
+	}{
+		{"empty", "", "0"},
+		{"duplicated IPs", "1.1.1.1,1.1.1.1,1.1.1.2", "2"},
+		{"overlapping prefixes", "1.1.1.0/24,1.1.1.128/25", "256"},
+		{"range inside prefix", "1.1.1.0/24,1.1.1.1-1.1.1.10", "256"},
+		{"mixed and disjoint", "1.1.1.1,1.1.1.11-1.1.1.15,1.2.1.0/24", "262"},
+		{"v6 prefix", "2001:db8::/64", "18446744073709551616"},
+		{"v4-mapped prefix", "::ffff:1.2.3.0/120", "256"},
+		{"v4-mapped and v4 counted once", "::ffff:1.2.3.4,1.2.3.4,1.2.3.0/24", "256"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			if got := m.Size().String(); got != tt.want {
+				t.Errorf("Megapool.Size() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMegapool_Compact(t *testing.T) {
+	var ips, prefixes, some []string
+	for i := 0; i < 256; i++ {
+		ips = append(ips, fmt.Sprintf("1.1.1.%d", i))
+		prefixes = append(prefixes, fmt.Sprintf("1.1.1.%d/32", 255-i))
+		if i >= 10 && i < 110 {
+			some = append(some, fmt.Sprintf("1.1.1.%d/32", i))
+		}
+	}
+	tests := []struct {
+		name string
+		main string
+		want string
+	}{
+		{"empty", "", ""},
+		{"256 consecutive ips", strings.Join(ips, ","), "1.1.1.0/24"},
+		{"256 consecutive /32s", strings.Join(prefixes, ","), "1.1.1.0/24"},
+		{"100 consecutive /32s", strings.Join(some, ","), "1.1.1.10-1.1.1.109"},
+		{"two /24s", strings.Join(ips, ",") + ",1.1.0.0/24", "1.1.0.0/23"},
+		{"isolated /32s", "1.1.1.1/32,1.1.1.3/32", "1.1.1.1,1.1.1.3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			if got := m.Compact(); got.String() != tt.want {
+				t.Errorf("Megapool.Compact() = %v, want %v", got.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestMegapool_IsNormalized(t *testing.T) {
+	tests := []struct {
+		name string
+		main string
+		want bool
+	}{
+		{"empty", "", true},
+		{"normalized", "1.1.1.1,1.1.1.5,1.1.2.0/24,2001:db8::/32,1.1.1.10-1.1.1.20", true},
+		{"bad ordering", "1.1.1.5,1.1.1.1", false},
+		{"overlap", "1.1.1.0/24,1.1.1.5", false},
+		{"adjacent prefixes", "1.1.0.0/24,1.1.1.0/24", false},
+		{"adjacent ips", "1.1.1.1,1.1.1.2", false},
+		{"duplicates", "1.1.1.1,1.1.1.1", false},
+		{"unmasked prefix", "1.1.1.1/24", false},
+		{"range that is a prefix", "1.1.1.0-1.1.1.255", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			if got := m.IsNormalized(); got != tt.want {
+				t.Errorf("Megapool.IsNormalized() = %v, want %v", got, tt.want)
+			}
+			if n := m.Normalize(AsIs); !n.IsNormalized() {
+				t.Errorf("Megapool.IsNormalized() = false for the output of Normalize")
+			}
+		})
+	}
+}
+
+func TestMegapool_CollapseIPsToRanges(t *testing.T) {
+	tests := []struct {
+		name string
+		main string
+		want string
+	}{
+		{"empty", "", ""},
+		{"consecutive run", "1.1.1.1,1.1.1.2,1.1.1.3", "1.1.1.1-1.1.1.3"},
+		{"unsorted with duplicates", "1.1.1.3,1.1.1.1,1.1.1.2,1.1.1.2", "1.1.1.1-1.1.1.3"},
+		{"run with a gap", "1.1.1.1,1.1.1.2,1.1.1.4,1.1.1.5,1.1.1.7", "1.1.1.7,1.1.1.1-1.1.1.2,1.1.1.4-1.1.1.5"},
+		{"split at block boundary", "1.1.1.254,1.1.1.255,1.1.2.0,1.1.2.1", "1.1.1.254-1.1.1.255,1.1.2.0-1.1.2.1"},
+		{"prefixes and ranges untouched", "1.1.1.1,1.1.1.0/24,1.1.1.2,2.2.2.2-2.2.2.4,1.1.1.3", "1.1.1.0/24,1.1.1.1-1.1.1.3,2.2.2.2-2.2.2.4"},
+		{"ipv6", "2001:db8::1,2001:db8::2,2001:db8::ff", "2001:db8::ff,2001:db8::1-2001:db8::2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			got := m.CollapseIPsToRanges()
+			if got.String() != tt.want {
+				t.Errorf("Megapool.CollapseIPsToRanges() = %v, want %v", got.String(), tt.want)
+			}
+			if _, err := NewMegapool(got.String()); err != nil {
+				t.Errorf("NewMegapool(%q) error = %v", got.String(), err)
+			}
+		})
+	}
+}
+
+func TestMegapool_Normalize(t *testing.T) {
+	tests := []struct {
+		name string
+		main string
+		rep  Representation
+		want []string
+	}{
+		{"empty", "", AsIs, nil},
+		{"as is", "1.1.1.3,1.1.1.0/30,1.1.1.4-1.1.1.9,1.1.2.0/24,1.1.3.7", AsIs, []string{"1.1.3.7", "1.1.2.0/24", "1.1.1.0-1.1.1.9"}},
+		{"prefer ranges", "1.1.1.3,1.1.1.0/30,1.1.1.4-1.1.1.9,1.1.2.0/24,1.1.3.7", PreferRanges, []string{"1.1.3.7", "1.1.1.0-1.1.1.9", "1.1.2.0-1.1.2.255"}},
+		{"prefer CIDRs", "1.1.1.3,1.1.1.0/30,1.1.1.4-1.1.1.9,1.1.2.0/24,1.1.3.7", PreferCIDRs, []string{"1.1.1.0/29", "1.1.1.8/31", "1.1.2.0/24", "1.1.3.7/32"}},
+		{"prefer ranges splits across blocks", "1.1.0.200-1.1.0.255,1.1.1.0/24,1.1.2.0", PreferRanges, []string{"1.1.2.0", "1.1.0.200-1.1.0.255", "1.1.1.0-1.1.1.255"}},
+		{"as is splits across blocks", "1.1.0.200-1.1.0.255,1.1.1.0/24,1.1.2.0-1.1.2.10", AsIs, []string{"1.1.1.0/24", "1.1.0.200-1.1.0.255", "1.1.2.0-1.1.2.10"}},
+		{"sorted across families", "2001:db8::1,1.1.1.1,2001:db8::/64,1.1.2.0/24", AsIs, []string{"1.1.1.1", "1.1.2.0/24", "2001:db8::/64"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			got := m.Normalize(tt.rep)
+			if !slices.Equal(got.AsSlice(), tt.want) {
+				t.Errorf("Megapool.Normalize() = %v, want %v", got.AsSlice(), tt.want)
+			}
+			if in := got.Intersection(m); got.Size().Cmp(m.Size()) != 0 || in.Size().Cmp(m.Size()) != 0 {
+				t.Errorf("Megapool.Normalize() = %v does not hold the addresses of %v", got.String(), m.String())
+			}
+			roundTrip, err := NewMegapool(got.String())
+			if err != nil || !roundTrip.Equal(got) {
+				t.Errorf("NewMegapool(%v) = %v, %v, want round-trip", got.String(), roundTrip.String(), err)
+			}
+		})
+	}
+}
+
+func TestMegapool_Union(t *testing.T) {
+	tests := []struct {
+		name string
+		main string
+		args []string
+		want string
+	}{
+		{"empty", "", nil, ""},
+		{"empty others", "1.1.1.1", []string{"", ""}, "1.1.1.1"},
+		{"duplicates", "1.1.1.1,1.1.1.1", []string{"1.1.1.1"}, "1.1.1.1"},
+		{"adjacent prefixes merged", "1.1.0.0/24", []string{"1.1.1.0/24"}, "1.1.0.0/23"},
+		{"range inside prefix", "1.1.1.0/24", []string{"1.1.1.5-1.1.1.10"}, "1.1.1.0/24"},
+		{"IPs extend range", "1.1.1.2-1.1.1.5", []string{"1.1.1.1", "1.1.1.6"}, "1.1.1.1-1.1.1.6"},
+		{"disjoint families", "1.1.1.1", []string{"2001:db8::/32"}, "1.1.1.1,2001:db8::/32"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			var others []Megapool
+			for _, v := range tt.args {
+				o, _ := NewMegapool(v)
+				others = append(others, o)
+			}
+			want, _ := NewMegapool(tt.want)
+			if got := m.Union(others...); !got.Equal(want) {
+				t.Errorf("Megapool.Union() = %v, want %v", got.String(), want.String())
+			}
+		})
+	}
+}
+
+func TestMergeAll(t *testing.T) {
+	tests := []struct {
+		name  string
+		pools []string
+	}{
+		{"empty", nil},
+		{"single", []string{"1.1.1.1,1.1.1.0/24"}},
+		{"several", []string{"1.1.1.1", "1.1.1.2-1.1.1.9", "1.1.2.0/24", "", "1.1.1.10-1.1.1.255", "2001:db8::1"}},
+		{"large", []string{largeInput(100), largeInput(200), "10.0.0.0/16"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var pools []Megapool
+			var want Megapool
+			for _, v := range tt.pools {
+				p, _ := NewMegapool(v)
+				pools = append(pools, p)
+				want = want.Union(p)
+			}
+			if got := MergeAll(pools); !got.Equal(want) {
+				t.Errorf("MergeAll() = %v, want %v", got.String(), want.String())
+			}
+		})
+	}
+}
+
+func BenchmarkMergeAll(b *testing.B) {
+	var pools []Megapool
+	for i := 0; i < 200; i++ {
+		p, _ := NewMegapool(fmt.Sprintf("10.%d.0.0/24,10.%d.1.1,10.%d.2.1-10.%d.2.50", i, i, i, i))
+		pools = append(pools, p)
+	}
+	b.Run("MergeAll", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			MergeAll(pools)
+		}
+	})
+	b.Run("repeated Union", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			var m Megapool
+			for _, p := range pools {
+				m = m.Union(p)
+			}
+		}
+	})
+}
+
+func TestMegapool_CompareSize(t *testing.T) {
+	tests := []struct {
+		name string
+		main string
+		args string
+		want int
+	}{
+		{"both empty", "", "", 0},
+		{"equal", "1.1.1.0/24", "1.1.2.0-1.1.2.255", 0},
+		{"smaller", "1.1.1.1,1.1.1.2", "1.1.1.0/24", -1},
+		{"larger", "2001:db8::/64", "0.0.0.0/0", 1},
+		{"duplicates not counted", "1.1.1.1,1.1.1.1,1.1.1.1", "1.1.1.0/31", -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			other, _ := NewMegapool(tt.args)
+			if got := m.CompareSize(other); got != tt.want {
+				t.Errorf("Megapool.CompareSize() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMegapool_CompareSize_Sort(t *testing.T) {
+	var pools []Megapool
+	for _, v := range []string{"1.1.0.0/16", "1.1.1.1", "", "1.1.1.0/24,1.1.2.0/24", "1.1.1.1-1.1.1.10"} {
+		m, _ := NewMegapool(v)
+		pools = append(pools, m)
+	}
+	slices.SortFunc(pools, func(a, b Megapool) int {
+		return a.CompareSize(b)
+	})
+	var got []string
+	for _, m := range pools {
+		got = append(got, m.String())
+	}
+	want := []string{"", "1.1.1.1", "1.1.1.1-1.1.1.10", "1.1.1.0/24,1.1.2.0/24", "1.1.0.0/16"}
+	if !slices.Equal(got, want) {
+		t.Errorf("slices.SortFunc(Megapool.CompareSize) = %v, want %v", got, want)
+	}
+}
+
+func TestMegapool_Intersection(t *testing.T) {
+	tests := []struct {
+		name string
+		main string
+		args string
+		want string
+	}{
+		{"empty", "", "1.1.1.0/24", ""},
+		{"disjoint", "1.1.1.0/24", "1.1.2.0/24", ""},
+		{"same IP", "1.1.1.1,2.2.2.2", "2.2.2.2", "2.2.2.2"},
+		{"prefix inside prefix", "1.1.0.0/16", "1.1.1.0/24", "1.1.1.0/24"},
+		{"range across prefix boundary", "1.1.1.0/25", "1.1.1.100-1.1.1.200", "1.1.1.100-1.1.1.127"},
+		{"range spanning blocks", "1.1.0.5-1.1.0.255,1.1.1.0/24,1.1.2.0-1.1.2.10", "1.0.0.0/8", "1.1.1.0/24,1.1.0.5-1.1.0.255,1.1.2.0-1.1.2.10"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			other, _ := NewMegapool(tt.args)
+			want, _ := NewMegapool(tt.want)
+			if got := m.Intersection(other); !got.Equal(want) {
+				t.Errorf("Megapool.Intersection() = %v, want %v", got.String(), want.String())
+			}
+		})
+	}
+}
+
+func TestMegapool_Diff(t *testing.T) {
+	tests := []struct {
+		name       string
+		main       string
+		target     string
+		wantAdd    string
+		wantRemove string
+	}{
+		{"both empty", "", "", "", ""},
+		{"from empty", "", "1.1.1.0/24", "1.1.1.0/24", ""},
+		{"to empty", "1.1.1.0/24", "", "", "1.1.1.0/24"},
+		{"equal in different forms", "1.1.1.0/25,1.1.1.128-1.1.1.255", "1.1.1.0/24", "", ""},
+		{"partial overlap", "1.1.1.0/24,2.2.2.2", "1.1.1.128/25,1.1.2.0/24,3.3.3.3", "3.3.3.3,1.1.2.0/24", "2.2.2.2,1.1.1.0/25"},
+		{"split an entry", "1.1.1.0/24", "1.1.1.0-1.1.1.4,1.1.1.6-1.1.1.255", "", "1.1.1.5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			target, _ := NewMegapool(tt.target)
+			add, remove := m.Diff(target)
+			if add.String() != tt.wantAdd || remove.String() != tt.wantRemove {
+				t.Errorf("Megapool.Diff() = %v, %v, want %v, %v", add.String(), remove.String(), tt.wantAdd, tt.wantRemove)
+			}
+			applied := m.Union(add)
+			applied = applied.Subtract(remove)
+			if applied.Relation(target) != RelEqual {
+				t.Errorf("applying Megapool.Diff() = %v, want %v", applied.String(), target.String())
+			}
+		})
+	}
+}
+
+func TestMegapool_Subtract(t *testing.T) {
+	tests := []struct {
+		name string
+		main string
+		args string
+		want string
+	}{
+		{"empty", "", "1.1.1.0/24", ""},
+		{"nothing to subtract", "1.1.1.0/24", "", "1.1.1.0/24"},
+		{"disjoint", "1.1.1.0/24", "1.1.2.0/24", "1.1.1.0/24"},
+		{"everything", "1.1.1.0/24", "1.1.0.0/16", ""},
+		{"IP from the middle of a prefix", "1.1.1.0/24", "1.1.1.5", "1.1.1.0-1.1.1.4,1.1.1.6-1.1.1.255"},
+		{"IP from the start of a prefix", "1.1.1.0/24", "1.1.1.0", "1.1.1.1-1.1.1.255"},
+		{"IP from the end of a prefix", "1.1.1.0/24", "1.1.1.255", "1.1.1.0-1.1.1.254"},
+		{"half of a prefix", "1.1.1.0/24", "1.1.1.128/25", "1.1.1.0/25"},
+		{"several holes", "1.1.1.0/24", "1.1.1.0/26,1.1.1.100-1.1.1.110,1.1.1.200", "1.1.1.64-1.1.1.99,1.1.1.111-1.1.1.199,1.1.1.201-1.1.1.255"},
+		{"one entry over several", "1.1.1.1,1.1.1.5-1.1.1.10,1.1.1.20", "1.1.1.0-1.1.1.8", "1.1.1.9-1.1.1.10,1.1.1.20"},
+		{"top of the address space", "255.255.255.0/24", "255.255.255.255", "255.255.255.0-255.255.255.254"},
+		{"other family untouched", "1.1.1.1,2001:db8::/32", "2001:db8::/16", "1.1.1.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			other, _ := NewMegapool(tt.args)
+			want, _ := NewMegapool(tt.want)
+			if got := m.Subtract(other); !got.Equal(want) {
+				t.Errorf("Megapool.Subtract() = %v, want %v", got.String(), want.String())
+			}
+		})
+	}
+}
+
+func TestMegapool_ClampTo(t *testing.T) {
+	tests := []struct {
+		name  string
+		main  string
+		bound netip.Prefix
+		want  string
+	}{
+		{"empty", "", p("1.1.1.0/24"), ""},
+		{"invalid bound", "1.1.1.1", netip.Prefix{}, ""},
+		{"fully inside", "1.1.1.1,1.1.1.128/26,1.1.1.10-1.1.1.20", p("1.1.1.0/24"), "1.1.1.1,1.1.1.128/26,1.1.1.10-1.1.1.20"},
+		{"fully outside dropped", "1.1.2.1,1.1.3.0/24,1.1.4.10-1.1.4.20", p("1.1.1.0/24"), ""},
+		{"range partly exits the bound", "1.1.1.100-1.1.1.200", p("1.1.1.128/25"), "1.1.1.128-1.1.1.200"},
+		{"range exits on both sides", "1.1.1.10-1.1.1.200", p("1.1.1.64/26"), "1.1.1.64/26"},
+		{"prefix wider than bound", "1.1.0.0/16", p("1.1.1.0/24"), "1.1.1.0/24"},
+		{"mixed", "1.1.1.1,2.2.2.2,1.1.0.0/23,1.1.1.250-1.1.1.255", p("1.1.1.0/24"), "1.1.1.0/24"},
+		{"other family dropped", "2001:db8::1,1.1.1.1", p("1.1.1.0/24"), "1.1.1.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			want, _ := NewMegapool(tt.want)
+			if got := m.ClampTo(tt.bound); !got.Equal(want) {
+				t.Errorf("Megapool.ClampTo() = %v, want %v", got.String(), want.String())
+			}
+		})
+	}
+}
+
+func TestMegapool_ToPrefixes(t *testing.T) {
+	tests := []struct {
+		name string
+		main string
+		want []netip.Prefix
+	}{
+		{"empty", "", nil},
+		{"IP", "1.1.1.1", []netip.Prefix{p("1.1.1.1/32")}},
+		{"CIDR masked", "1.1.1.1/24", []netip.Prefix{p("1.1.1.0/24")}},
+		{"range decomposed", "1.1.1.1-1.1.1.6", []netip.Prefix{p("1.1.1.1/32"), p("1.1.1.2/31"), p("1.1.1.4/31"), p("1.1.1.6/32")}},
+		{"aggregated", "1.1.1.0/25,1.1.1.128-1.1.1.255,1.1.2.0/24,1.1.3.0/24,1.1.3.5", []netip.Prefix{p("1.1.1.0/24"), p("1.1.2.0/23")}},
+		{"sorted across families", "2001:db8::/32,1.1.1.1", []netip.Prefix{p("1.1.1.1/32"), p("2001:db8::/32")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			if got := m.ToPrefixes(); !slices.Equal(got, tt.want) {
+				t.Errorf("Megapool.ToPrefixes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMegapool_ToPrefixesLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		main    string
+		max     int
+		want    []netip.Prefix
+		wantErr bool
+	}{
+		{"empty", "", 0, nil, false},
+		{"small range under the limit", "1.1.1.1-1.1.1.6", 4, []netip.Prefix{p("1.1.1.1/32"), p("1.1.1.2/31"), p("1.1.1.4/31"), p("1.1.1.6/32")}, false},
+		{"small range over the limit", "1.1.1.1-1.1.1.6", 3, nil, true},
+		{"limit spans entries", "1.1.1.1,1.1.1.3,1.1.1.5", 2, nil, true},
+		{"aggregated under the limit", "1.1.1.0/25,1.1.1.128-1.1.1.255", 1, []netip.Prefix{p("1.1.1.0/24")}, false},
+		{"zero limit", "1.1.1.1", 0, nil, true},
+		{"negative limit", "", -1, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			got, err := m.ToPrefixesLimit(tt.max)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Megapool.ToPrefixesLimit() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Megapool.ToPrefixesLimit() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMegapool_ToPrefixesLimit_LargeRange(t *testing.T) {
+	// A /8-sized range, which the parser does not accept but the set
+	// operations produce.
+	r := Range{From: netip.MustParseAddr("1.0.0.1"), To: netip.MustParseAddr("1.255.255.254")}
+	m := Megapool{RangePool: []Range{r}}
+	if _, err := m.ToPrefixesLimit(32); err == nil {
+		t.Errorf("Megapool.ToPrefixesLimit() error = nil, want an error")
+	}
+	got, err := m.ToPrefixesLimit(46)
+	if err != nil || len(got) != 46 {
+		t.Errorf("Megapool.ToPrefixesLimit() = %d prefixes, %v, want 46, nil", len(got), err)
+	}
+}
+
+func TestMegapool_PrefixCount(t *testing.T) {
+	tests := []struct {
+		name string
+		main string
+		want int
+	}{
+		{"empty", "", 0},
+		{"single CIDR", "1.1.1.0/24", 1},
+		{"range decomposes into several prefixes", "1.1.1.1-1.1.1.6", 4},
+		{"range decomposes into one prefix", "1.1.1.0-1.1.1.255", 1},
+		{"aggregatable set collapses", "1.1.0.0/24,1.1.1.0/24,1.1.2.0/24,1.1.3.0/24", 1},
+		{"duplicates collapse", "1.1.1.1,1.1.1.1,1.1.1.0/31", 1},
+		{"disjoint", "1.1.1.1,1.1.1.3", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			if got := m.PrefixCount(); got != tt.want {
+				t.Errorf("Megapool.PrefixCount() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMegapool_PrefixLengthHistogram(t *testing.T) {
+	tests := []struct {
+		name string
+		main string
+		want map[int]int
+	}{
+		{"empty", "", map[int]int{}},
+		{"IPs", "1.1.1.1,1.1.1.2,2001:db8::1", map[int]int{32: 2, 128: 1}},
+		{"several lengths", "1.0.0.0/8,2.2.0.0/16,3.3.3.0/24,4.4.4.0/24,2001:db8::/32", map[int]int{8: 1, 16: 1, 24: 2, 32: 1}},
+		{"range of several lengths", "1.1.1.1-1.1.1.6", map[int]int{31: 2, 32: 2}},
+		{"mixed", "1.1.1.1,1.1.2.0/24,1.1.3.0-1.1.3.255,1.1.4.0-1.1.4.2", map[int]int{24: 2, 31: 1, 32: 2}},
+		{"not aggregated", "1.1.1.0/25,1.1.1.128/25", map[int]int{25: 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			if got := m.PrefixLengthHistogram(); !maps.Equal(got, tt.want) {
+				t.Errorf("Megapool.PrefixLengthHistogram() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMegapool_SnapRangesToCIDR(t *testing.T) {
+	tests := []struct {
+		name string
+		main Megapool
+		want string
+	}{
+		{"empty", Megapool{}, ""},
+		{"IPs and CIDRs untouched", Megapool{IPPool: []netip.Addr{a("1.1.1.1")}, PrefixPool: []netip.Prefix{p("1.1.2.0/24")}}, "1.1.1.1,1.1.2.0/24"},
+		{"ranges snapped", Megapool{
+			IPPool:    []netip.Addr{a("2.2.2.2")},
+			RangePool: []Range{{From: a("1.1.1.1"), To: a("1.1.1.200")}, {From: a("1.1.4.5"), To: a("1.1.7.7")}},
+		}, "2.2.2.2,1.1.1.0/24,1.1.4.0/22"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.main.SnapRangesToCIDR()
+			if got.String() != tt.want {
+				t.Errorf("Megapool.SnapRangesToCIDR() = %v, want %v", got.String(), tt.want)
+			}
+			if in := got.Intersection(tt.main); in.Size().Cmp(tt.main.Size()) != 0 {
+				t.Errorf("Megapool.SnapRangesToCIDR() = %v does not cover %v", got.String(), tt.main.String())
+			}
+		})
+	}
+}
+
+func TestMegapool_SplitSingletonsAndRanges(t *testing.T) {
+	tests := []struct {
+		name       string
+		main       string
+		wantAddrs  []netip.Addr
+		wantRanges []Range
+	}{
+		{"empty", "", nil, nil},
+		{"one singleton and one range", "1.1.1.10-1.1.1.20,2.2.2.2,1.1.1.15,1.1.1.21", []netip.Addr{a("2.2.2.2")}, []Range{{From: a("1.1.1.10"), To: a("1.1.1.21")}}},
+		{"adjacent ips merge into a range", "1.1.1.1,1.1.1.2,1.1.1.4", []netip.Addr{a("1.1.1.4")}, []Range{{From: a("1.1.1.1"), To: a("1.1.1.2")}}},
+		{"single address prefix", "1.1.1.1/32,2001:db8::/128", []netip.Addr{a("1.1.1.1"), a("2001:db8::")}, nil},
+		{"prefixes spanning blocks", "1.1.0.0/24,1.1.1.0/24", nil, []Range{{From: a("1.1.0.0"), To: a("1.1.1.255")}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			addrs, ranges := m.SplitSingletonsAndRanges()
+			if !slices.Equal(addrs, tt.wantAddrs) || !slices.Equal(ranges, tt.wantRanges) {
+				t.Errorf("Megapool.SplitSingletonsAndRanges() = %v, %v, want %v, %v", addrs, ranges, tt.wantAddrs, tt.wantRanges)
+			}
+		})
+	}
+}
+
+func TestMegapool_MinMax(t *testing.T) {
+	tests := []struct {
+		name    string
+		main    string
+		wantMin netip.Addr
+		wantMax netip.Addr
+		wantOk  bool
+	}{
+		{"empty", "", netip.Addr{}, netip.Addr{}, false},
+		{"single IP", "1.1.1.1", a("1.1.1.1"), a("1.1.1.1"), true},
+		{"min from prefix network, max from range To", "1.1.1.50,1.1.1.10/24,1.1.2.1-1.1.2.20,1.1.2.15", a("1.1.1.0"), a("1.1.2.20"), true},
+		{"max from prefix broadcast", "1.1.1.5,1.1.2.0/24,1.1.2.1-1.1.2.20", a("1.1.1.5"), a("1.1.2.255"), true},
+		{"mixed family", "2001:db8::/32,1.1.1.1,1.1.1.5-1.1.1.10", a("1.1.1.1"), a("2001:db8:ffff:ffff:ffff:ffff:ffff:ffff"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			gotMin, ok := m.Min()
+			if gotMin != tt.wantMin || ok != tt.wantOk {
+				t.Errorf("Megapool.Min() = %v, %v, want %v, %v", gotMin, ok, tt.wantMin, tt.wantOk)
+			}
+			gotMax, ok := m.Max()
+			if gotMax != tt.wantMax || ok != tt.wantOk {
+				t.Errorf("Megapool.Max() = %v, %v, want %v, %v", gotMax, ok, tt.wantMax, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestMegapool_AsSinglePrefix(t *testing.T) {
+	tests := []struct {
+		name   string
+		main   string
+		want   netip.Prefix
+		wantOk bool
+	}{
+		{"empty", "", netip.Prefix{}, false},
+		{"clean block", "1.1.1.0/24", p("1.1.1.0/24"), true},
+		{"unmasked block", "1.1.1.7/24", p("1.1.1.0/24"), true},
+		{"misaligned range", "1.1.1.0-1.1.1.200", netip.Prefix{}, false},
+		{"aligned range", "1.1.1.0-1.1.1.255", p("1.1.1.0/24"), true},
+		{"range of the right size but misaligned", "1.1.1.1-1.1.1.2", netip.Prefix{}, false},
+		{"two entries forming a block", "1.1.1.0/25,1.1.1.128-1.1.1.255", p("1.1.1.0/24"), true},
+		{"two disjoint entries", "1.1.1.0/24,1.1.3.0/24", netip.Prefix{}, false},
+		{"single ip", "1.1.1.1", p("1.1.1.1/32"), true},
+		{"ipv6", "2001:db8::/32", p("2001:db8::/32"), true},
+		{"mixed family", "1.1.1.1,2001:db8::1", netip.Prefix{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			got, ok := m.AsSinglePrefix()
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("Megapool.AsSinglePrefix() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestMegapool_FitsInPrefixLen(t *testing.T) {
+	tests := []struct {
+		name string
+		main string
+		bits int
+		want bool
+	}{
+		{"empty", "", 24, true},
+		{"fits in a /24", "1.1.1.1,1.1.1.5-1.1.1.10,1.1.1.128/25", 24, true},
+		{"needs a /22", "1.1.0.1,1.1.3.1", 24, false},
+		{"fits in a /22", "1.1.0.1,1.1.3.1", 22, true},
+		{"single /24", "1.1.1.0/24", 24, true},
+		{"larger than a /24", "1.1.0.0/23", 24, false},
+		{"single address", "1.1.1.1", 32, true},
+		{"mixed family", "1.1.1.1,2001:db8::1", 0, false},
+		{"ipv6", "2001:db8::1,2001:db8::ffff", 112, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			if got := m.FitsInPrefixLen(tt.bits); got != tt.want {
+				t.Errorf("Megapool.FitsInPrefixLen() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMegapool_EnclosingPrefix(t *testing.T) {
+	tests := []struct {
+		name   string
+		main   string
+		want   netip.Prefix
+		wantOk bool
+	}{
+		{"empty", "", netip.Prefix{}, false},
+		{"single IP", "1.1.1.1", p("1.1.1.1/32"), true},
+		{"single CIDR", "1.1.1.1/24", p("1.1.1.0/24"), true},
+		{"spans exactly a /24", "1.1.1.0,1.1.1.100-1.1.1.200,1.1.1.255", p("1.1.1.0/24"), true},
+		{"needs a /22", "1.1.0.5,1.1.3.7", p("1.1.0.0/22"), true},
+		{"needs a /22 with CIDRs", "1.1.1.0/24,1.1.2.0-1.1.2.10", p("1.1.0.0/22"), true},
+		{"everything", "0.0.0.0,255.255.255.255", p("0.0.0.0/0"), true},
+		{"v6", "2001:db8::1,2001:db8::ff", p("2001:db8::/120"), true},
+		{"mixed family", "1.1.1.1,2001:db8::1", netip.Prefix{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			got, ok := m.EnclosingPrefix()
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("Megapool.EnclosingPrefix() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestMegapool_Subnets(t *testing.T) {
+	tests := []struct {
+		name string
+		main string
+		bits int
+		want []string
+	}{
+		{"empty", "", 26, nil},
+		{"four /26 children of a /24", "1.1.1.0/24", 26, []string{"1.1.1.0/26", "1.1.1.64/26", "1.1.1.128/26", "1.1.1.192/26"}},
+		{"same length", "1.1.1.0/24", 24, []string{"1.1.1.0/24"}},
+		{"narrower entries skipped", "1.1.1.0/27,1.1.1.1,1.1.2.0/25", 26, []string{"1.1.2.0/26", "1.1.2.64/26"}},
+		{"ips and ranges as prefixes", "1.1.1.1,1.1.2.6-1.1.2.7", 32, []string{"1.1.1.1/32", "1.1.2.6/32", "1.1.2.7/32"}},
+		{"range", "1.1.2.0-1.1.2.127", 26, []string{"1.1.2.0/26", "1.1.2.64/26"}},
+		{"v4 skipped for v6 length", "1.1.1.0/24,2001:db8::/63", 64, []string{"2001:db8::/64", "2001:db8:0:1::/64"}},
+		{"top of the address space", "255.255.255.0/24", 25, []string{"255.255.255.0/25", "255.255.255.128/25"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			var got []string
+			for p := range m.Subnets(tt.bits) {
+				got = append(got, p.String())
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Megapool.Subnets() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMegapool_Subnets_Break(t *testing.T) {
+	m, _ := NewMegapool("10.0.0.0/8")
+	n := 0
+	for range m.Subnets(32) {
+		if n++; n == 3 {
+			break
+		}
+	}
+	if n != 3 {
+		t.Errorf("Megapool.Subnets() yielded %d prefixes after break, want 3", n)
+	}
+}
+
+func TestMegapool_GapsWithin(t *testing.T) {
+	tests := []struct {
+		name   string
+		main   string
+		parent netip.Prefix
+		want   []Range
+	}{
+		{"empty pool", "", p("1.1.1.0/24"), []Range{{From: a("1.1.1.0"), To: a("1.1.1.255")}}},
+		{"fully allocated", "1.1.0.0/16", p("1.1.1.0/24"), nil},
+		{"three sub-blocks allocated", "1.1.1.64/26,1.1.1.10-1.1.1.19,1.1.1.200", p("1.1.1.0/24"), []Range{
+			{From: a("1.1.1.0"), To: a("1.1.1.9")},
+			{From: a("1.1.1.20"), To: a("1.1.1.63")},
+			{From: a("1.1.1.128"), To: a("1.1.1.199")},
+			{From: a("1.1.1.201"), To: a("1.1.1.255")},
+		}},
+		{"allocations outside the parent ignored", "1.1.0.0/24,1.1.1.0/25,1.1.2.0/24", p("1.1.1.0/24"), []Range{{From: a("1.1.1.128"), To: a("1.1.1.255")}}},
+		{"gap across blocks", "1.1.0.0/24,1.1.3.0/24", p("1.1.0.0/22"), []Range{{From: a("1.1.1.0"), To: a("1.1.2.255")}}},
+		{"invalid parent", "1.1.0.0/24", netip.Prefix{}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			if got := m.GapsWithin(tt.parent); !slices.Equal(got, tt.want) {
+				t.Errorf("Megapool.GapsWithin() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMegapool_InternalGaps(t *testing.T) {
+	tests := []struct {
+		name string
+		main string
+		want []Range
+	}{
+		{"empty", "", nil},
+		{"mixed family", "1.1.1.1,2001:db8::1", nil},
+		{"single block", "1.1.1.0/24", nil},
+		{"parts of a /24", "1.1.1.0-1.1.1.9,1.1.1.64/26,1.1.1.255", []Range{
+			{From: a("1.1.1.10"), To: a("1.1.1.63")},
+			{From: a("1.1.1.128"), To: a("1.1.1.254")},
+		}},
+		{"gap at the end of the enclosing prefix", "1.1.1.0/26,1.1.1.128", []Range{{From: a("1.1.1.64"), To: a("1.1.1.127")}, {From: a("1.1.1.129"), To: a("1.1.1.255")}}},
+		{"across blocks", "1.1.0.0/24,1.1.3.0/24", []Range{{From: a("1.1.1.0"), To: a("1.1.2.255")}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			if got := m.InternalGaps(); !slices.Equal(got, tt.want) {
+				t.Errorf("Megapool.InternalGaps() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMegapool_CoverageBy(t *testing.T) {
+	tests := []struct {
+		name string
+		main string
+		args string
+		want string
+	}{
+		{"empty", "", "1.1.1.0/24", "0"},
+		{"no coverage", "1.1.1.0/24", "2.2.2.0/24", "0"},
+		{"half of a /24", "1.1.1.0/24", "1.1.1.128/25", "1/2"},
+		{"full coverage", "1.1.1.0/24", "1.1.0.0/16", "1"},
+		{"duplicates counted once", "1.1.1.1,1.1.1.1,1.1.1.2", "1.1.1.1", "1/2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			other, _ := NewMegapool(tt.args)
+			if got := m.CoverageBy(other).RatString(); got != tt.want {
+				t.Errorf("Megapool.CoverageBy() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMegapool_Jaccard(t *testing.T) {
+	tests := []struct {
+		name string
+		main string
+		args string
+		want string
+	}{
+		{"both empty", "", "", "0"},
+		{"one empty", "1.1.1.0/24", "", "0"},
+		{"identical", "1.1.1.0/24", "1.1.1.0/24", "1"},
+		{"identical in different forms", "1.1.1.0/24", "1.1.1.0-1.1.1.127,1.1.1.128/25", "1"},
+		{"disjoint", "1.1.1.0/24", "2.2.2.0/24", "0"},
+		{"half overlap", "1.1.1.0/25", "1.1.1.0/24", "1/2"},
+		{"overlapping by a third", "1.1.1.0-1.1.1.99", "1.1.1.50-1.1.1.149", "1/3"},
+		{"duplicates counted once", "1.1.1.1,1.1.1.1", "1.1.1.1,1.1.1.2", "1/2"},
+		{"dual-stack", "1.1.1.1,2001:db8::1", "2001:db8::1", "1/2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			other, _ := NewMegapool(tt.args)
+			if got := m.Jaccard(other).RatString(); got != tt.want {
+				t.Errorf("Megapool.Jaccard() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseItemsParallel(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		workers int
+	}{
+		{"one worker", largeInput(100), 1},
+		{"more workers than items", "1.1.1.1,1.1.1.0/24#office,1.1.1.1-1.1.1.10", 8},
+		{"uneven chunks", largeInput(1001), 7},
+		{"tags", "1.1.1.1#a,1.1.1.2#b,1.1.1.1#c,1.1.1.3,1.1.1.2#d", 3},
+		{"first error reported", "1.1.1.1,1.1.1,2.2.2.2,3.3.3,4.4.4.4,5.5.5", 3},
+		{"large input", largeInput(parallelParseThreshold), 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			all := splitItems(strings.TrimSpace(tt.input))
+			wantTags := map[string]string{}
+			want, wantErr := parseItems(all, parseConfig{tags: wantTags})
+			for _, cfg := range []parseConfig{{}, {presize: true}, {presize: true, hint: 10}} {
+				cfg.tags = map[string]string{}
+				got, err := parseItemsParallel(all, cfg, tt.workers)
+				if fmt.Sprint(err) != fmt.Sprint(wantErr) {
+					t.Errorf("parseItemsParallel() error = %v, want %v", err, wantErr)
+					return
+				}
+				if !slices.Equal(got.AsSlice(), want.AsSlice()) {
+					t.Errorf("parseItemsParallel() = %v, want %v", got.String(), want.String())
+				}
+				if wantErr == nil && !maps.Equal(cfg.tags, wantTags) {
+					t.Errorf("parseItemsParallel() tags = %v, want %v", cfg.tags, wantTags)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkNewMegapool_Large(b *testing.B) {
+	all := splitItems(strings.TrimSpace(largeInput(parallelParseThreshold)))
+	b.Run("serial", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := parseItems(all, parseConfig{}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("parallel", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := parseItemsParallel(all, parseConfig{}, runtime.GOMAXPROCS(0)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestNewMegapoolFromReaderCtx(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		want      string
+		wantLines []int
+		wantErr   bool
+	}{
+		{"empty", "", "", nil, false},
+		{"one entry per line", "1.1.1.1\n1.1.1.0/24\n1.1.1.1-1.1.1.10\n", "1.1.1.1,1.1.1.0/24,1.1.1.1-1.1.1.10", []int{1, 2, 3}, false},
+		{"no trailing newline", "1.1.1.1\n2.2.2.2", "1.1.1.1,2.2.2.2", []int{1, 2}, false},
+		{"blank lines and separators", "1.1.1.1, 2.2.2.2\n\n3.3.3.3;4.4.4.4\n", "1.1.1.1,2.2.2.2,3.3.3.3,4.4.4.4", []int{1, 2, 3}, false},
+		{"bad line", "1.1.1.1\n1.1.1\n", "", []int{1}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var lines []int
+			got, err := NewMegapoolFromReaderCtx(context.Background(), strings.NewReader(tt.input), func(n int) {
+				lines = append(lines, n)
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewMegapoolFromReaderCtx() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			want, _ := NewMegapool(tt.want)
+			if !got.Equal(want) {
+				t.Errorf("NewMegapoolFromReaderCtx() = %v, want %v", got.String(), want.String())
+			}
+			if !slices.Equal(lines, tt.wantLines) {
+				t.Errorf("NewMegapoolFromReaderCtx() lines = %v, want %v", lines, tt.wantLines)
+			}
+		})
+	}
+}
+
+func TestNewMegapoolFromReaderCtx_Cancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var lines []int
+	_, err := NewMegapoolFromReaderCtx(ctx, strings.NewReader("1.1.1.1\n2.2.2.2\n3.3.3.3\n4.4.4.4\n"), func(n int) {
+		lines = append(lines, n)
+		if n == 2 {
+			cancel()
+		}
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("NewMegapoolFromReaderCtx() error = %v, want %v", err, context.Canceled)
+	}
+	if !slices.Equal(lines, []int{1, 2}) {
+		t.Errorf("NewMegapoolFromReaderCtx() lines = %v, want %v", lines, []int{1, 2})
+	}
+}
+
+func TestBuildFromChan(t *testing.T) {
+	tests := []struct {
+		name    string
+		msgs    []string
+		opts    []Option
+		want    string
+		wantErr bool
+	}{
+		{"nothing", nil, nil, "", false},
+		{"several messages", []string{"1.1.1.1", "2.2.2.0/24,3.3.3.3", "1.1.1.5-1.1.1.9"}, nil, "1.1.1.1,3.3.3.3,2.2.2.0/24,1.1.1.5-1.1.1.9", false},
+		{"options applied", []string{"1.1.1.*"}, []Option{WithWildcards()}, "1.1.1.0/24", false},
+		{"fail fast", []string{"1.1.1.1", "2.2.2", "3.3.3.3"}, nil, "", true},
+		{"collect errors", []string{"1.1.1.1", "2.2.2", "3.3.3.3", "4.4"}, []Option{WithCollectErrors()}, "1.1.1.1,3.3.3.3", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch := make(chan string, len(tt.msgs))
+			for _, msg := range tt.msgs {
+				ch <- msg
+			}
+			close(ch)
+			got, err := BuildFromChan(context.Background(), ch, tt.opts...)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("BuildFromChan() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got.String() != tt.want {
+				t.Errorf("BuildFromChan() = %v, want %v", got.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildFromChan_CollectErrors(t *testing.T) {
+	ch := make(chan string, 3)
+	ch <- "2.2.2"
+	ch <- "1.1.1.1"
+	ch <- "1.1.1.1-2001:db8::1"
+	close(ch)
+	_, err := BuildFromChan(context.Background(), ch, WithCollectErrors())
+	if !errors.Is(err, ErrBadElement) || !errors.Is(err, ErrMixedFamily) {
+		t.Errorf("BuildFromChan() error = %v, want both failures", err)
+	}
+	if want := "message 1: "; !strings.HasPrefix(err.Error(), want) || !strings.Contains(err.Error(), "\nmessage 3: ") {
+		t.Errorf("BuildFromChan() error = %q, want the failing message numbers", err)
+	}
+}
+
+func TestBuildFromChan_Cancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := make(chan string)
+	done := make(chan error)
+	go func() {
+		_, err := BuildFromChan(ctx, ch)
+		done <- err
+	}()
+	ch <- "1.1.1.1"
+	ch <- "2.2.2.2"
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("BuildFromChan() error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestNewMegapool_MixedFamilyRange(t *testing.T) {
+	_, err := NewMegapool("1.1.1.1,1.1.1.1-2001:db8::1")
+	want := "not an accepted range: ipv4 and ipv6 addresses cannot be mixed: value=1.1.1.1-2001:db8::1"
+	if err == nil || err.Error() != want {
+		t.Errorf("NewMegapool() error = %v, want %v", err, want)
+	}
+}
+
+func TestNewMegapool_ErrorSentinels(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		opts  []Option
+		want  error
+	}{
+		{"mixed family", "1.1.1.1-2001:db8::1", nil, ErrMixedFamily},
+		{"mixed family the other way", "2001:db8::1-1.1.1.1", nil, ErrMixedFamily},
+		{"reversed range", "1.1.1.10-1.1.1.1", nil, ErrReversedRange},
+		{"reversed across blocks", "1.1.2.1-1.1.1.1", nil, ErrReversedRange},
+		{"reversed v6 range", "2001:db8::ff-2001:db8::1", nil, ErrReversedRange},
+		{"malformed token", "1.1.1", nil, ErrBadElement},
+		{"range across blocks", "1.1.1.1-1.1.2.1", nil, ErrBadElement},
+		{"single address range", "1.1.1.1-1.1.1.1", nil, ErrBadElement},
+		{"unbalanced brackets", "[2001:db8::1", nil, ErrBadElement},
+		{"unbalanced quotes", `"1.1.1.1`, nil, ErrBadElement},
+		{"bad wildcard", "1.*.1.1", []Option{WithWildcards()}, ErrBadElement},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewMegapool("2.2.2.2,"+tt.input, tt.opts...)
+			for _, sentinel := range []error{ErrMixedFamily, ErrReversedRange, ErrBadElement} {
+				if got := errors.Is(err, sentinel); got != (sentinel == tt.want) {
+					t.Errorf("errors.Is(%v, %v) = %v, want %v", err, sentinel, got, !got)
+				}
+			}
+		})
+	}
+}
+
+func TestErrorSentinels_Elsewhere(t *testing.T) {
+	_, err := FromCSV([][]string{{"range", "1.1.1.10", "1.1.1.1"}})
+	if !errors.Is(err, ErrReversedRange) {
+		t.Errorf("FromCSV() error = %v, want %v", err, ErrReversedRange)
+	}
+	_, err = FromCSV([][]string{{"host", "1.1.1.1"}})
+	if !errors.Is(err, ErrBadElement) {
+		t.Errorf("FromCSV() error = %v, want %v", err, ErrBadElement)
+	}
+	_, err = RangeFromBigInts(big.NewInt(2), big.NewInt(1), false)
+	if !errors.Is(err, ErrReversedRange) {
+		t.Errorf("RangeFromBigInts() error = %v, want %v", err, ErrReversedRange)
+	}
+	var r Range
+	if err := r.UnmarshalJSON([]byte(`{"from":"1.1.1.1","to":"2001:db8::1"}`)); !errors.Is(err, ErrMixedFamily) {
+		t.Errorf("Range.UnmarshalJSON() error = %v, want %v", err, ErrMixedFamily)
+	}
+}
+
+func TestNewMegapool_WithSingleAddressRanges(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		opts     []Option
+		want     string
+		wantSize string
+		wantErr  bool
+	}{
+		{"strict rejects degenerate range", "1.1.1.5-1.1.1.5", nil, "", "0", true},
+		{"degenerate range as IP", "1.1.1.5-1.1.1.5", []Option{WithSingleAddressRanges()}, "1.1.1.5", "1", false},
+		{"degenerate v4-mapped range as IP", "::ffff:1.1.1.5-1.1.1.5", []Option{WithSingleAddressRanges()}, "1.1.1.5", "1", false},
+		{"degenerate v6 range as IP", "2001:db8::1-2001:db8::1", []Option{WithSingleAddressRanges()}, "2001:db8::1", "1", false},
+		{"tagged degenerate range", "1.1.1.5-1.1.1.5#gw", []Option{WithSingleAddressRanges()}, "1.1.1.5", "1", false},
+		{"regular range unchanged", "1.1.1.5-1.1.1.6", []Option{WithSingleAddressRanges()}, "1.1.1.5-1.1.1.6", "2", false},
+		{"reversed range still rejected", "1.1.1.6-1.1.1.5", []Option{WithSingleAddressRanges()}, "", "0", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewMegapool(tt.input, tt.opts...)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewMegapool() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got.String() != tt.want {
+				t.Errorf("NewMegapool() = %v, want %v", got.String(), tt.want)
+			}
+			if size := got.Size().String(); size != tt.wantSize {
+				t.Errorf("Megapool.Size() = %v, want %v", size, tt.wantSize)
+			}
+		})
+	}
+}
+
+func TestNewMegapool_WithWildcards(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		opts    []Option
+		want    string
+		wantErr bool
+	}{
+		{"rejected by default", "1.1.1.*", nil, "", true},
+		{"single octet", "1.1.1.*", []Option{WithWildcards()}, "1.1.1.0/24", false},
+		{"double octet", "1.1.*.*", []Option{WithWildcards()}, "1.1.0.0/16", false},
+		{"triple octet", "10.*.*.*", []Option{WithWildcards()}, "10.0.0.0/8", false},
+		{"everything", "*.*.*.*", []Option{WithWildcards()}, "0.0.0.0/0", false},
+		{"mixed with other entries", "1.1.1.*#office, 2.2.2.2,3.3.3.0/24", []Option{WithWildcards()}, "2.2.2.2,1.1.1.0/24,3.3.3.0/24", false},
+		{"interior wildcard", "1.*.1.1", []Option{WithWildcards()}, "", true},
+		{"interior wildcard after trailing", "1.*.1.*", []Option{WithWildcards()}, "", true},
+		{"partial octet", "1.1.1.1*", []Option{WithWildcards()}, "", true},
+		{"too few octets", "1.1.*", []Option{WithWildcards()}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewMegapool(tt.input, tt.opts...)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewMegapool() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got.String() != tt.want {
+				t.Errorf("NewMegapool() = %v, want %v", got.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestNewMegapoolCIDROnly(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr string
+	}{
+		{"empty", "", "", ""},
+		{"only CIDRs", "1.0.0.0/8, 2.2.2.0/24;2001:db8::/32", "1.0.0.0/8,2.2.2.0/24,2001:db8::/32", ""},
+		{"bare IP", "1.0.0.0/8,2.2.2.2", "", "not a cidr block: value=2.2.2.2, use 2.2.2.2/32 instead"},
+		{"bare v6 IP", "2001:db8::1", "", "not a cidr block: value=2001:db8::1, use 2001:db8::1/128 instead"},
+		{"range", "1.0.0.0/8,1.1.1.1-1.1.1.6", "", "not a cidr block: value=1.1.1.1-1.1.1.6, use 1.1.1.1/32,1.1.1.2/31,1.1.1.4/31,1.1.1.6/32 instead"},
+		{"not parseable", "1.0.0.0/88", "", "not an ip, cidr block or ip range: value=1.0.0.0/88"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewMegapoolCIDROnly(tt.input)
+			if (err != nil) != (tt.wantErr != "") || (err != nil && err.Error() != tt.wantErr) {
+				t.Errorf("NewMegapoolCIDROnly() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			want, _ := NewMegapool(tt.want)
+			if !got.Equal(want) {
+				t.Errorf("NewMegapoolCIDROnly() = %v, want %v", got.String(), want.String())
+			}
+		})
+	}
+}
+
+func TestNewMegapoolNoRanges(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr string
+	}{
+		{"empty", "", "", ""},
+		{"IPs and CIDRs", "1.0.0.0/8, 2.2.2.2;2001:db8::/32,2001:db8::1", "1.0.0.0/8,2.2.2.2,2001:db8::/32,2001:db8::1", ""},
+		{"range", "1.0.0.0/8,1.1.1.1-1.1.1.6", "", "not an ip or cidr block: value=1.1.1.1-1.1.1.6, use 1.1.1.1,1.1.1.2/31,1.1.1.4/31,1.1.1.6 instead"},
+		{"aligned range", "1.1.1.0-1.1.1.255", "", "not an ip or cidr block: value=1.1.1.0-1.1.1.255, use 1.1.1.0/24 instead"},
+		{"v6 range", "2001:db8::-2001:db8::1", "", "not an ip or cidr block: value=2001:db8::-2001:db8::1, use 2001:db8::/127 instead"},
+		{"not parseable", "1.0.0.0/88", "", "not an ip, cidr block or ip range: value=1.0.0.0/88"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewMegapoolNoRanges(tt.input)
+			if (err != nil) != (tt.wantErr != "") || (err != nil && err.Error() != tt.wantErr) {
+				t.Errorf("NewMegapoolNoRanges() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			want, _ := NewMegapool(tt.want)
+			if !got.Equal(want) {
+				t.Errorf("NewMegapoolNoRanges() = %v, want %v", got.String(), want.String())
+			}
+		})
+	}
+}
+
+func TestNewMegapoolExclusiveRanges(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		want     string
+		wantSize string
+		wantErr  bool
+	}{
+		{"empty", "", "", "0", false},
+		{"range", "1.1.1.0-1.1.1.10", "1.1.1.0-1.1.1.9", "10", false},
+		{"two addresses", "1.1.1.0-1.1.1.2", "1.1.1.0-1.1.1.1", "2", false},
+		{"single address", "1.1.1.0-1.1.1.1", "1.1.1.0", "1", false},
+		{"IPs and CIDRs unchanged", "1.1.1.1,1.1.2.0/24,1.1.3.0-1.1.4.0", "1.1.1.1,1.1.2.0/24,1.1.3.0-1.1.3.255", "513", false},
+		{"whole block", "1.1.1.0-1.1.2.0", "1.1.1.0-1.1.1.255", "256", false},
+		{"up to the last address", "1.1.3.0-1.1.3.255", "1.1.3.0-1.1.3.254", "255", false},
+		{"v6 whole block", "2001:db8::-2001:db8::100", "2001:db8::-2001:db8::ff", "256", false},
+		{"empty range", "1.1.1.5-1.1.1.5", "", "0", true},
+		{"beyond the next block", "1.1.1.0-1.1.2.1", "", "0", true},
+		{"tagged range", "1.1.1.0-1.1.1.10#lab", "1.1.1.0-1.1.1.9", "10", false},
+		{"reversed range", "1.1.1.10-1.1.1.0", "", "0", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewMegapoolExclusiveRanges(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewMegapoolExclusiveRanges() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if opt, _ := NewMegapool(tt.input, WithExclusiveRanges()); !opt.Equal(got) {
+				t.Errorf("NewMegapool(WithExclusiveRanges()) = %v, want %v", opt.String(), got.String())
+			}
+			want, _ := NewMegapool(tt.want)
+			if got.String() != want.String() {
+				t.Errorf("NewMegapoolExclusiveRanges() = %v, want %v", got.String(), want.String())
+			}
+			if size := got.Size().String(); size != tt.wantSize {
+				t.Errorf("Megapool.Size() = %v, want %v", size, tt.wantSize)
+			}
+			roundTrip, err := NewMegapool(got.String())
+			if err != nil || !roundTrip.Equal(got) {
+				t.Errorf("NewMegapool(%v) = %v, %v, want round-trip", got.String(), roundTrip.String(), err)
+			}
+		})
+	}
+}
+
+func TestNewMegapoolExclusiveRanges_StringIsInclusive(t *testing.T) {
+	m, _ := NewMegapoolExclusiveRanges("1.1.1.0-1.1.1.10,1.1.2.0-1.1.2.2")
+	again, err := NewMegapoolExclusiveRanges(m.String())
+	if err != nil {
+		t.Fatalf("NewMegapoolExclusiveRanges() error = %v", err)
+	}
+	if got, want := again.String(), "1.1.2.0,1.1.1.0-1.1.1.8"; got != want {
+		t.Errorf("NewMegapoolExclusiveRanges(%v) = %v, want %v", m.String(), got, want)
+	}
+}
+
+func TestNewMegapoolExclusiveRanges_Overlaps(t *testing.T) {
+	m, _ := NewMegapoolExclusiveRanges("1.1.1.0-1.1.1.10")
+	tests := []struct {
+		name string
+		args string
+		want bool
+	}{
+		{"last included address", "1.1.1.9", true},
+		{"excluded upper bound", "1.1.1.10", false},
+		{"range from excluded upper bound", "1.1.1.10-1.1.1.20", false},
+		{"range over last included address", "1.1.1.9-1.1.1.20", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			other, _ := NewMegapool(tt.args)
+			if got := m.Overlaps(other); got != tt.want {
+				t.Errorf("Megapool.Overlaps() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if !m.HasMaxSize(10) || m.HasMaxSize(9) {
+		t.Errorf("Megapool.HasMaxSize() does not count 10 addresses")
+	}
+}
+
+func TestNewMegapoolWithCapacity(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		hint  int
+		opts  []Option
+	}{
+		{"empty", "", 0, nil},
+		{"only separators", ",,,", 10, nil},
+		{"derived hint", "8.8.8.8,8.8.8.7;1.0.0.0/8, 2.0.0.0/8;		3.0.0.0/8,1.1.1.1-1.1.1.10", 0, nil},
+		{"small hint", "8.8.8.8,8.8.8.7;1.0.0.0/8, 2.0.0.0/8;		3.0.0.0/8,1.1.1.1-1.1.1.10", 1, nil},
+		{"large hint", "8.8.8.8,8.8.8.7;1.0.0.0/8, 2.0.0.0/8;		3.0.0.0/8,1.1.1.1-1.1.1.10", 100, nil},
+		{"large input", largeInput(1000), 3000, nil},
+		{"parallel input", largeInput(parallelParseThreshold), 0, nil},
+		{"options", "1.1.1.*,1.1.1.5-1.1.1.5,1.1.1.1", 0, []Option{WithWildcards(), WithSingleAddressRanges()}},
+		{"error", "8.8.8.8,8.8.8", 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want, wantErr := NewMegapool(tt.input, tt.opts...)
+			got, err := NewMegapoolWithCapacity(tt.input, tt.hint, tt.opts...)
+			if (err != nil) != (wantErr != nil) {
+				t.Errorf("NewMegapoolWithCapacity() error = %v, want %v", err, wantErr)
+				return
+			}
+			if !got.Equal(want) || !slices.Equal(got.AsSlice(), want.AsSlice()) {
+				t.Errorf("NewMegapoolWithCapacity() = %v, want %v", got.String(), want.String())
+			}
+		})
+	}
+}
+
+func TestMegapool_InternalOverlaps(t *testing.T) {
+	tests := []struct {
+		name string
+		main string
+		want []Overlap
+	}{
+		{"empty", "", nil},
+		{"disjoint", "1.1.1.1,1.1.2.0/24,1.1.3.1-1.1.3.10,1.1.3.11", nil},
+		{"adjacent is not overlapping", "1.1.1.0/25,1.1.1.128/25", nil},
+		{"IP inside a listed prefix", "1.1.1.5,1.1.1.0/24", []Overlap{{"1.1.1.5", "1.1.1.0/24"}}},
+		{"two overlapping ranges", "1.1.1.1-1.1.1.10,1.1.1.5-1.1.1.20", []Overlap{{"1.1.1.1-1.1.1.10", "1.1.1.5-1.1.1.20"}}},
+		{"range inside another", "1.1.1.1-1.1.1.100,1.1.1.5-1.1.1.20", []Overlap{{"1.1.1.1-1.1.1.100", "1.1.1.5-1.1.1.20"}}},
+		{"literal duplicate", "1.1.1.1,1.1.1.1", []Overlap{{"1.1.1.1", "1.1.1.1"}}},
+		{"several", "1.1.1.5,1.1.2.1,1.1.1.0/24,1.1.0.0/16,1.1.1.1-1.1.1.10", []Overlap{
+			{"1.1.1.5", "1.1.1.0/24"},
+			{"1.1.1.5", "1.1.0.0/16"},
+			{"1.1.1.5", "1.1.1.1-1.1.1.10"},
+			{"1.1.2.1", "1.1.0.0/16"},
+			{"1.1.1.0/24", "1.1.0.0/16"},
+			{"1.1.1.0/24", "1.1.1.1-1.1.1.10"},
+			{"1.1.0.0/16", "1.1.1.1-1.1.1.10"},
+		}},
+		{"other family", "1.1.1.1,::/0", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			if got := m.InternalOverlaps(); !slices.Equal(got, tt.want) {
+				t.Errorf("Megapool.InternalOverlaps() = %v, want %v", got, tt.want)
+			}
+			if got := m.HasInternalOverlap(); got != (len(tt.want) > 0) {
+				t.Errorf("Megapool.HasInternalOverlap() = %v, want %v", got, len(tt.want) > 0)
+			}
+		})
+	}
+}
+
+func TestMegapool_RemoveNested(t *testing.T) {
+	tests := []struct {
+		name string
+		main string
+		want string
+	}{
+		{"empty", "", ""},
+		{"nested /16 under a /8", "10.1.0.0/16,10.0.0.0/8", "10.0.0.0/8"},
+		{"ip inside a prefix", "1.1.1.1,1.1.1.0/24,2.2.2.2", "2.2.2.2,1.1.1.0/24"},
+		{"ip inside a range", "1.1.1.5,1.1.1.1-1.1.1.10", "1.1.1.1-1.1.1.10"},
+		{"range inside a prefix", "1.1.1.1-1.1.1.10,1.1.1.0/24", "1.1.1.0/24"},
+		{"prefix inside a range", "1.1.1.0/30,1.1.1.0-1.1.1.10", "1.1.1.0-1.1.1.10"},
+		{"duplicates keep one", "1.1.1.0/24,1.1.1.0/24,1.1.1.1,1.1.1.1", "1.1.1.0/24"},
+		{"same coverage keeps the prefix", "1.1.1.0-1.1.1.3,1.1.1.0/30", "1.1.1.0/30"},
+		{"adjacent kept", "1.1.1.0/25,1.1.1.128/25", "1.1.1.0/25,1.1.1.128/25"},
+		{"partial overlap kept", "1.1.1.1-1.1.1.10,1.1.1.5-1.1.1.20", "1.1.1.1-1.1.1.10,1.1.1.5-1.1.1.20"},
+		{"dual-stack", "2001:db8::1,2001:db8::/32,1.1.1.1", "1.1.1.1,2001:db8::/32"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			got := m.RemoveNested()
+			if got.String() != tt.want {
+				t.Errorf("Megapool.RemoveNested() = %v, want %v", got.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestMegapool_Duplicates(t *testing.T) {
+	tests := []struct {
+		name string
+		main string
+		want []string
+	}{
+		{"empty", "", nil},
+		{"no duplicates", "1.1.1.1,1.1.2.0/24,1.1.3.1-1.1.3.10", nil},
+		{"literal duplicate CIDR", "1.1.2.0/24,1.1.1.1,1.1.2.0/24", []string{"1.1.2.0/24"}},
+		{"duplicate CIDR in other form", "1.1.2.0/24,1.1.2.1/24", []string{"1.1.2.0/24"}},
+		{"reported once", "1.1.1.1,1.1.1.1,1.1.1.1", []string{"1.1.1.1"}},
+		{"duplicate range", "1.1.3.1-1.1.3.10,1.1.3.1-1.1.3.10", []string{"1.1.3.1-1.1.3.10"}},
+		{"IP shadowed by prefix", "1.1.2.5,1.1.2.0/24", []string{"1.1.2.5"}},
+		{"IP shadowed by range", "1.1.3.5,1.1.3.1-1.1.3.10", []string{"1.1.3.5"}},
+		{"duplicated and shadowed IP", "1.1.2.5,1.1.2.5,1.1.2.0/24", []string{"1.1.2.5"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			if got := m.Duplicates(); !slices.Equal(got, tt.want) {
+				t.Errorf("Megapool.Duplicates() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func BenchmarkNewMegapool(b *testing.B) {
+	benchmarkParse(b, func(input string) (Megapool, error) {
+		return NewMegapool(input)
+	})
+}
+
+func BenchmarkNewMegapoolWithCapacity(b *testing.B) {
+	benchmarkParse(b, func(input string) (Megapool, error) {
+		return NewMegapoolWithCapacity(input, 0)
+	})
+}
+
+func benchmarkParse(b *testing.B, parse func(string) (Megapool, error)) {
+	var ips strings.Builder
+	for i := 0; i < 30000; i++ {
+		fmt.Fprintf(&ips, "10.%d.%d.1\n", i>>8&255, i&255)
+	}
+	inputs := []struct {
+		name  string
+		input string
+	}{
+		{"mixed", largeInput(10000)},
+		{"ips", ips.String()},
+	}
+	for _, in := range inputs {
+		b.Run(in.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := parse(in.input); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// largeInput returns n IPs, n CIDR blocks and n ranges spread over 10.0.0.0/8.
+func largeInput(n int) string {
+	var sb strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&sb, "10.%d.%d.1,10.%d.%d.0/28,10.%d.%d.20-10.%d.%d.30\n",
+			i>>8&255, i&255, i>>8&255, i&255, i>>8&255, i&255, i>>8&255, i&255)
+	}
+	return sb.String()
+}
+
+func TestMegapool_EqualNormalized(t *testing.T) {
+	tests := []struct {
+		name  string
+		main  string
+		other string
+		want  bool
+	}{
+		{"empty", "", "", true},
+		{"same entries", "1.1.1.1,1.1.2.0/24,1.1.3.1-1.1.3.9", "1.1.3.1-1.1.3.9,1.1.2.0/24,1.1.1.1", true},
+		{"same addresses written differently", "1.1.1.0/25,1.1.1.128/25", "1.1.1.0-1.1.1.255", true},
+		{"different", "1.1.1.1,1.1.2.0/24", "1.1.1.1,1.1.3.0/24", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			other, _ := NewMegapool(tt.other)
+			m, other = m.Normalize(AsIs), other.Normalize(AsIs)
+			if got := m.EqualNormalized(other); got != tt.want {
+				t.Errorf("Megapool.EqualNormalized() = %v, want %v", got, tt.want)
+			}
+			if got := m.Equal(other); got != tt.want {
+				t.Errorf("Megapool.Equal() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMegapool_EqualNormalized_NotNormalized(t *testing.T) {
+	m, _ := NewMegapool("1.1.1.1,2.2.2.2")
+	other, _ := NewMegapool("2.2.2.2,1.1.1.1")
+	if !m.Equal(other) {
+		t.Errorf("Megapool.Equal() = false, want true")
+	}
+	if m.EqualNormalized(other) {
+		t.Errorf("Megapool.EqualNormalized() = true on pools in a different order, want false as they are not normalized")
+	}
+}
+
+func TestMegapool_SplitByFamily(t *testing.T) {
+	tests := []struct {
+		name   string
+		main   string
+		wantV4 string
+		wantV6 string
+	}{
+		{"empty", "", "", ""},
+		{"only v4", "1.1.1.1,1.1.1.0/24,1.1.1.1-1.1.1.10", "1.1.1.1,1.1.1.0/24,1.1.1.1-1.1.1.10", ""},
+		{"only v6", "2001:db8::1,2001:db8::/32,::1-::5", "", "2001:db8::1,2001:db8::/32,::1-::5"},
+		{"dual-stack", "1.1.1.1,2001:db8::1,1.1.1.0/24,2001:db8::/32,::1-::5,1.1.1.1-1.1.1.10,::ffff:2.2.2.2#tag", "1.1.1.1,2.2.2.2,1.1.1.0/24,1.1.1.1-1.1.1.10", "2001:db8::1,2001:db8::/32,::1-::5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			v4, v6 := m.SplitByFamily()
+			if v4.String() != tt.wantV4 || v6.String() != tt.wantV6 {
+				t.Errorf("Megapool.SplitByFamily() = %v, %v, want %v, %v", v4.String(), v6.String(), tt.wantV4, tt.wantV6)
+			}
+			if !v4.IsEmpty() && !v4.HasOnlyIPv4() {
+				t.Errorf("Megapool.SplitByFamily() v4 = %v is not IPv4 only", v4.String())
+			}
+			if _, ok := v6.EnclosingPrefix(); !v6.IsEmpty() && (!ok || v6.HasOnlyIPv4()) {
+				t.Errorf("Megapool.SplitByFamily() v6 = %v is not IPv6 only", v6.String())
+			}
+			union := v4.Union(v6)
+			if want := m.Normalize(AsIs); !union.Equal(want) {
+				t.Errorf("Megapool.SplitByFamily() union = %v, want %v", union.String(), want.String())
+			}
+		})
+	}
+}
+
+func TestMegapool_Walk(t *testing.T) {
+	m, _ := NewMegapool("2.2.2.2,1.1.1.20-1.1.1.25,10.0.0.0/8,1.1.1.1,2001:db8::/32,1.1.1.5-1.1.1.10,1.0.0.0/8,1.0.0.0/16,::1")
+	var addrs []netip.Addr
+	var prefixes []netip.Prefix
+	var ranges []Range
+	m.Walk(
+		func(a netip.Addr) { addrs = append(addrs, a) },
+		func(p netip.Prefix) { prefixes = append(prefixes, p) },
+		func(r Range) { ranges = append(ranges, r) },
+	)
+	wantAddrs := []netip.Addr{a("1.1.1.1"), a("2.2.2.2"), a("::1")}
+	if !slices.Equal(addrs, wantAddrs) {
+		t.Errorf("Megapool.Walk() addrs = %v, want %v", addrs, wantAddrs)
+	}
+	wantPrefixes := []netip.Prefix{p("1.0.0.0/8"), p("1.0.0.0/16"), p("10.0.0.0/8"), p("2001:db8::/32")}
+	if !slices.Equal(prefixes, wantPrefixes) {
+		t.Errorf("Megapool.Walk() prefixes = %v, want %v", prefixes, wantPrefixes)
+	}
+	wantRanges := []Range{{From: a("1.1.1.5"), To: a("1.1.1.10")}, {From: a("1.1.1.20"), To: a("1.1.1.25")}}
+	if !slices.Equal(ranges, wantRanges) {
+		t.Errorf("Megapool.Walk() ranges = %v, want %v", ranges, wantRanges)
+	}
+
+	addrs = nil
+	m.Walk(func(a netip.Addr) { addrs = append(addrs, a) }, nil, nil)
+	if !slices.Equal(addrs, wantAddrs) {
+		t.Errorf("Megapool.Walk() addrs = %v, want %v", addrs, wantAddrs)
+	}
+	if got := m.IPPool[0].String(); got != "2.2.2.2" {
+		t.Errorf("Megapool.Walk() reordered the pool, first entry = %v", got)
+	}
+}
+
+func TestMegapool_WriteTo(t *testing.T) {
+	tests := []struct {
+		name string
+		main string
+	}{
+		{"empty", ""},
+		{"one entry", "1.1.1.1"},
+		{"mixed", "1.1.1.5-1.1.1.10,2001:db8::/32,1.1.1.1,10.0.0.0/8,::1"},
+		{"larger than the buffer", largeInput(2000)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			var buf bytes.Buffer
+			n, err := m.WriteTo(&buf)
+			if err != nil {
+				t.Fatalf("Megapool.WriteTo() error = %v", err)
+			}
+			if want := m.String(); buf.String() != want || n != int64(len(want)) {
+				t.Errorf("Megapool.WriteTo() = %d, %q, want %d, %q", n, buf.String(), len(want), want)
+			}
+		})
+	}
+}
+
+func TestMegapool_WriteSeparated(t *testing.T) {
+	m, _ := NewMegapool("1.1.1.5-1.1.1.10,1.1.1.1,10.0.0.0/8")
+	var buf bytes.Buffer
+	if _, err := m.WriteSeparated(&buf, "\n"); err != nil {
+		t.Fatalf("Megapool.WriteSeparated() error = %v", err)
+	}
+	if want := "1.1.1.1\n10.0.0.0/8\n1.1.1.5-1.1.1.10"; buf.String() != want {
+		t.Errorf("Megapool.WriteSeparated() = %q, want %q", buf.String(), want)
+	}
+}
+
+// failingWriter accepts up to n bytes, then fails.
+type failingWriter struct {
+	n int
+}
+
+var errWriterFull = errors.New("writer full")
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		n := w.n
+		w.n = 0
+		return n, errWriterFull
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+func TestMegapool_WriteTo_Error(t *testing.T) {
+	for _, input := range []string{"1.1.1.1", largeInput(2000)} {
+		m, _ := NewMegapool(input)
+		n, err := m.WriteTo(&failingWriter{n: 5})
+		if !errors.Is(err, errWriterFull) || n != 5 {
+			t.Errorf("Megapool.WriteTo() = %d, %v, want 5, %v", n, err, errWriterFull)
+		}
+	}
+}
+
+func TestMegapool_CanonicalString(t *testing.T) {
+	tests := []struct {
+		name  string
+		main  string
+		other string
+		want  string
+	}{
+		{"empty", "", "", ""},
+		{"reordered", "2.2.2.2,1.1.1.1", "1.1.1.1,2.2.2.2", "1.1.1.1,2.2.2.2"},
+		{"split prefix", "1.1.1.0/24", "1.1.1.128/25,1.1.1.0/25", "1.1.1.0/24"},
+		{"range and prefix", "1.1.1.0-1.1.1.255,1.1.2.0/24", "1.1.0.0/16,1.1.0.0/24", ""},
+		{"ips, range and duplicates", "1.1.1.1,1.1.1.2,1.1.1.3,1.1.1.2", "1.1.1.1-1.1.1.3", "1.1.1.1-1.1.1.3"},
+		{"unmasked prefix", "1.1.1.7/24", "1.1.1.0/24", "1.1.1.0/24"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			other, _ := NewMegapool(tt.other)
+			got := m.CanonicalString()
+			if tt.want != "" && got != tt.want {
+				t.Errorf("Megapool.CanonicalString() = %v, want %v", got, tt.want)
+			}
+			if eq := m.Relation(other) == RelEqual; (got == other.CanonicalString()) != eq {
+				t.Errorf("Megapool.CanonicalString() = %v and %v, same addresses = %v", got, other.CanonicalString(), eq)
+			}
+		})
+	}
+	m, _ := NewMegapool("1.1.1.2,1.1.1.1")
+	if got := m.String(); got != "1.1.1.1,1.1.1.2" {
+		t.Errorf("Megapool.String() = %v, want the entries unmerged", got)
+	}
+}
+
+func TestMegapool_AsIPSet(t *testing.T) {
+	tests := []struct {
+		name string
+		main string
+		want string
+	}{
+		{"empty", "", ""},
+		{"mixed", "1.1.1.1,1.1.1.5-1.1.1.10,2.2.2.1/24,2001:db8::1,2001:db8::/32", "1.1.1.1/32\n2001:db8::1/128\n2.2.2.0/24\n2001:db8::/32\n1.1.1.5-1.1.1.10\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			if got := m.AsIPSet(); got != tt.want {
+				t.Errorf("Megapool.AsIPSet() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMegapool_TreeString(t *testing.T) {
+	tests := []struct {
+		name string
+		main string
+		want string
+	}{
+		{"empty", "", ""},
+		{"a /16 and two of its /24 children", "10.1.2.0/24,10.1.0.0/16,10.1.1.0/24", "10.1.0.0/16\n  10.1.1.0/24\n  10.1.2.0/24\n"},
+		{"deeper nesting", "10.0.0.0/8,10.1.1.1,10.1.0.0/16,10.2.0.0/16,10.1.1.0/24", "10.0.0.0/8\n  10.1.0.0/16\n    10.1.1.0/24\n      10.1.1.1/32\n  10.2.0.0/16\n"},
+		{"siblings at top level", "10.1.0.0/16,1.1.1.1,2001:db8::/32,2001:db8::1", "1.1.1.1/32\n10.1.0.0/16\n2001:db8::/32\n  2001:db8::1/128\n"},
+		{"range decomposed and duplicates dropped", "1.1.1.0/24,1.1.1.1-1.1.1.3,1.1.1.1", "1.1.1.0/24\n  1.1.1.1/32\n  1.1.1.2/31\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			if got := m.TreeString(); got != tt.want {
+				t.Errorf("Megapool.TreeString() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFromPrefixHostCount(t *testing.T) {
+	tests := []struct {
+		name    string
+		prefix  netip.Prefix
+		n       int
+		want    string
+		wantErr bool
+	}{
+		{"10 hosts from a /24", p("1.1.1.0/24"), 10, "1.1.1.1-1.1.1.10", false},
+		{"unmasked prefix", p("1.1.1.77/24"), 10, "1.1.1.1-1.1.1.10", false},
+		{"one host", p("1.1.1.0/24"), 1, "1.1.1.1", false},
+		{"all hosts of a /24", p("1.1.1.0/24"), 254, "1.1.1.1-1.1.1.254", false},
+		{"more than a /24 holds", p("1.1.1.0/24"), 255, "", true},
+		{"all hosts of a /30", p("1.1.1.0/30"), 2, "1.1.1.1-1.1.1.2", false},
+		{"more than a /30 holds", p("1.1.1.0/30"), 3, "", true},
+		{"both addresses of a /31", p("1.1.1.0/31"), 2, "1.1.1.0/31", false},
+		{"a /32", p("1.1.1.1/32"), 1, "1.1.1.1", false},
+		{"hosts across blocks", p("1.1.0.0/16"), 300, "1.1.0.1-1.1.0.255,1.1.1.0-1.1.1.44", false},
+		{"v6 uses every address", p("2001:db8::/64"), 4, "2001:db8::/126", false},
+		{"zero hosts", p("1.1.1.0/24"), 0, "", true},
+		{"invalid prefix", netip.Prefix{}, 1, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := FromPrefixHostCount(tt.prefix, tt.n)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("FromPrefixHostCount() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			want, _ := NewMegapool(tt.want)
+			if !got.Equal(want) {
+				t.Errorf("FromPrefixHostCount() = %v, want %v", got.String(), want.String())
+			}
+			if err == nil && got.Size().Int64() != int64(tt.n) {
+				t.Errorf("FromPrefixHostCount() size = %v, want %v", got.Size(), tt.n)
+			}
+		})
+	}
+}
+
+func TestMegapool_ToIPNets(t *testing.T) {
+	tests := []struct {
+		name string
+		main string
+		want []string
+	}{
+		{"empty", "", nil},
+		{"IPs", "1.1.1.1,2001:db8::1", []string{"1.1.1.1/32", "2001:db8::1/128"}},
+		{"CIDRs are masked", "1.1.1.1/24,2001:db8::1/32", []string{"1.1.1.0/24", "2001:db8::/32"}},
+		{"range decomposed", "1.1.1.1-1.1.1.6", []string{"1.1.1.1/32", "1.1.1.2/31", "1.1.1.4/31", "1.1.1.6/32"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			var got []string
+			for _, n := range m.ToIPNets() {
+				if m.HasOnlyIPv4() && len(n.IP) != net.IPv4len {
+					t.Errorf("Megapool.ToIPNets() IP %v has length %d, want %d", n.IP, len(n.IP), net.IPv4len)
+				}
+				got = append(got, n.String())
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Megapool.ToIPNets() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFromIPNets(t *testing.T) {
+	tests := []struct {
+		name string
+		nets []net.IPNet
+		want string
+	}{
+		{"empty", nil, ""},
+		{"v4 with 4 byte IP", []net.IPNet{{IP: net.IP{1, 1, 1, 0}, Mask: net.CIDRMask(24, 32)}}, "1.1.1.0/24"},
+		{"v4 with 16 byte IP", []net.IPNet{{IP: net.ParseIP("1.1.1.0"), Mask: net.CIDRMask(24, 32)}}, "1.1.1.0/24"},
+		{"v4 host", []net.IPNet{{IP: net.ParseIP("1.1.1.1"), Mask: net.CIDRMask(32, 32)}}, "1.1.1.1"},
+		{"v6", []net.IPNet{{IP: net.ParseIP("2001:db8::"), Mask: net.CIDRMask(32, 128)}}, "2001:db8::/32"},
+		{"v6 host", []net.IPNet{{IP: net.ParseIP("2001:db8::1"), Mask: net.CIDRMask(128, 128)}}, "2001:db8::1"},
+		{"v4-mapped", []net.IPNet{{IP: net.ParseIP("::ffff:1.1.1.0"), Mask: net.CIDRMask(120, 128)}}, "1.1.1.0/24"},
+		{"invalid skipped", []net.IPNet{{IP: nil, Mask: net.CIDRMask(24, 32)}, {IP: net.ParseIP("2001:db8::"), Mask: net.CIDRMask(24, 32)}}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want, _ := NewMegapool(tt.want)
+			if got := FromIPNets(tt.nets); !got.Equal(want) {
+				t.Errorf("FromIPNets() = %v, want %v", got.String(), want.String())
+			}
+		})
+	}
+}
+
+func TestMegapool_IPNetsRoundTrip(t *testing.T) {
+	tests := []string{
+		"",
+		"1.1.1.1,2.2.2.2",
+		"1.0.0.0/8,2.2.2.0/24,3.3.3.3",
+		"2001:db8::/32,2001:db8::1,1.1.1.0/24",
+	}
+	for _, tt := range tests {
+		t.Run(tt, func(t *testing.T) {
+			m, _ := NewMegapool(tt)
+			if got := FromIPNets(m.ToIPNets()); !got.Equal(m) {
+				t.Errorf("FromIPNets(Megapool.ToIPNets()) = %v, want %v", got.String(), m.String())
+			}
+		})
+	}
+}
+
+func p(s string) netip.Prefix {
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+func a(s string) netip.Addr {
+	a, err := netip.ParseAddr(s)
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+func TestMegapool_Add(t *testing.T) {
+	tests := []struct {
+		name    string
+		main    string
+		items   []string
+		want    string
+		wantErr bool
+	}{
+		{"nothing", "1.1.1.1", nil, "1.1.1.1", false},
+		{"to empty", "", []string{"1.1.1.1"}, "1.1.1.1", false},
+		{"every category", "1.1.1.1", []string{"1.1.2.0/24", "1.1.3.1-1.1.3.5", "2.2.2.2"}, "1.1.1.1,2.2.2.2,1.1.2.0/24,1.1.3.1-1.1.3.5", false},
+		{"separated items", "1.1.1.1", []string{"2.2.2.2,3.3.3.3;4.4.4.4"}, "1.1.1.1,2.2.2.2,3.3.3.3,4.4.4.4", false},
+		{"duplicates kept", "1.1.1.1", []string{"1.1.1.1"}, "1.1.1.1,1.1.1.1", false},
+		{"error leaves pool unchanged", "1.1.1.1", []string{"2.2.2.2", "3.3.3"}, "1.1.1.1", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			if err := m.Add(tt.items...); (err != nil) != tt.wantErr {
+				t.Errorf("Megapool.Add() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := m.String(); got != tt.want {
+				t.Errorf("Megapool.Add() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMegapool_Remove(t *testing.T) {
+	tests := []struct {
+		name    string
+		main    string
+		items   []string
+		want    string
+		wantErr bool
+	}{
+		{"nothing", "10.0.0.0/24", nil, "10.0.0.0/24", false},
+		{"from empty", "", []string{"10.0.0.5"}, "", false},
+		{"middle of a prefix", "10.0.0.0/24", []string{"10.0.0.5"}, "10.0.0.0-10.0.0.4,10.0.0.6-10.0.0.255", false},
+		{"start of a prefix", "10.0.0.0/24", []string{"10.0.0.0"}, "10.0.0.1-10.0.0.255", false},
+		{"end of a prefix", "10.0.0.0/24", []string{"10.0.0.255"}, "10.0.0.0-10.0.0.254", false},
+		{"from a larger prefix", "10.0.0.0/23", []string{"10.0.1.5"}, "10.0.0.0/24,10.0.1.0-10.0.1.4,10.0.1.6-10.0.1.255", false},
+		{"an ip", "1.1.1.1,2.2.2.2", []string{"1.1.1.1"}, "2.2.2.2", false},
+		{"duplicate ips", "1.1.1.1,1.1.1.1", []string{"1.1.1.1"}, "", false},
+		{"from a range", "1.1.1.1-1.1.1.10", []string{"1.1.1.5"}, "1.1.1.1-1.1.1.4,1.1.1.6-1.1.1.10", false},
+		{"untouched entries keep their form", "1.1.1.0/24,2.2.2.2,3.3.3.0/24", []string{"1.1.1.0/25"}, "2.2.2.2,1.1.1.128/25,3.3.3.0/24", false},
+		{"several items", "10.0.0.0/24", []string{"10.0.0.5", "10.0.0.128/25"}, "10.0.0.0-10.0.0.4,10.0.0.6-10.0.0.127", false},
+		{"everything", "10.0.0.0/24,10.0.0.1", []string{"10.0.0.0/16"}, "", false},
+		{"error leaves pool unchanged", "10.0.0.0/24", []string{"10.0.0.5", "10.0.0"}, "10.0.0.0/24", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			if err := m.Remove(tt.items...); (err != nil) != tt.wantErr {
+				t.Errorf("Megapool.Remove() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := m.String(); got != tt.want {
+				t.Errorf("Megapool.Remove() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewMegapool_FirstToken(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		opts    []Option
+		want    string
+		wantErr bool
+	}{
+		{"BGP line", "10.0.0.0/8 65001 65002 i", []Option{WithFirstToken()}, "10.0.0.0/8", false},
+		{"BGP dump", "10.0.0.0/8 65001 65002 i\n192.168.0.0/16\t65003 ?\n1.1.1.1", []Option{WithFirstToken()}, "1.1.1.1,10.0.0.0/8,192.168.0.0/16", false},
+		{"plain line", "1.1.1.1,2.2.2.0/24", []Option{WithFirstToken()}, "1.1.1.1,2.2.2.0/24", false},
+		{"leading whitespace", "  1.1.1.0/24 65001", []Option{WithFirstToken()}, "1.1.1.0/24", false},
+		{"range", "1.1.1.1-1.1.1.5 65001", []Option{WithFirstToken()}, "1.1.1.1-1.1.1.5", false},
+		{"tagged", "1.1.1.0/24 65001#office", []Option{WithFirstToken()}, "1.1.1.0/24", false},
+		{"invalid first token", "65001 10.0.0.0/8", []Option{WithFirstToken()}, "", true},
+		{"without the option", "10.0.0.0/8 65001 65002 i", nil, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewMegapool(tt.input, tt.opts...)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewMegapool() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got.String() != tt.want {
+				t.Errorf("NewMegapool() = %v, want %v", got.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestNewMegapool_CommentPrefixes(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		opts    []Option
+		want    string
+		wantErr bool
+	}{
+		{"route export", "; AS13335\n1.1.1.0/24\n1.0.0.0/24\n; AS15169\n8.8.8.0/24", []Option{WithCommentPrefixes()}, "1.0.0.0/24,1.1.1.0/24,8.8.8.0/24", false},
+		{"hash lines", "# office\n1.1.1.1\n  # vpn\n2.2.2.2", []Option{WithCommentPrefixes()}, "1.1.1.1,2.2.2.2", false},
+		{"comment entry", "1.1.1.1, # tail, 2.2.2.2", []Option{WithCommentPrefixes()}, "1.1.1.1,2.2.2.2", false},
+		{"labels kept apart from comments", "# office\n1.1.1.0/24#office", []Option{WithCommentPrefixes()}, "1.1.1.0/24", false},
+		{"custom prefix", "// AS13335\n1.1.1.0/24", []Option{WithCommentPrefixes("//")}, "1.1.1.0/24", false},
+		{"custom prefix only", "; AS13335\n1.1.1.0/24", []Option{WithCommentPrefixes("//")}, "", true},
+		{"only comments", "; AS13335\n# nothing", []Option{WithCommentPrefixes()}, "", false},
+		{"without the option", "; AS13335\n1.1.1.0/24", nil, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewMegapool(tt.input, tt.opts...)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewMegapool() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got.String() != tt.want {
+				t.Errorf("NewMegapool() = %v, want %v", got.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestNewMegapool_CommentPrefixes_ParseError(t *testing.T) {
+	input := "; AS13335\n1.1.1.0/24\n; AS15169\n8.8.8"
+	_, err := NewMegapool(input, WithCommentPrefixes())
+	var pe *ParseError
+	if !errors.As(err, &pe) || pe.Value != "8.8.8" || pe.Offset != strings.Index(input, "8.8.8") {
+		t.Errorf("NewMegapool() error = %#v, want a *ParseError for 8.8.8 at %v", err, strings.Index(input, "8.8.8"))
+	}
+}
+
+func TestNewMegapoolFromSources(t *testing.T) {
+	m, origins, err := NewMegapoolFromSources(map[string]string{
+		"b.txt": "10.0.0.0/8,2.2.2.2",
+		"a.txt": "1.1.1.1,10.1.0.0/16\n2.2.2.2",
+	})
+	if err != nil {
+		t.Fatalf("NewMegapoolFromSources() error = %v", err)
+	}
+	if got, want := m.String(), "1.1.1.1,2.2.2.2,2.2.2.2,10.0.0.0/8,10.1.0.0/16"; got != want {
+		t.Errorf("NewMegapoolFromSources() = %v, want %v", got, want)
+	}
+	wantOrigins := map[string]string{
+		"1.1.1.1":     "a.txt",
+		"2.2.2.2":     "a.txt",
+		"10.1.0.0/16": "a.txt",
+		"10.0.0.0/8":  "b.txt",
+	}
+	if !maps.Equal(origins, wantOrigins) {
+		t.Errorf("NewMegapoolFromSources() origins = %v, want %v", origins, wantOrigins)
+	}
+	var conflicts []string
+	for _, o := range m.InternalOverlaps() {
+		if origins[o.A] != origins[o.B] {
+			conflicts = append(conflicts, fmt.Sprintf("%v (%v) and %v (%v)", o.A, origins[o.A], o.B, origins[o.B]))
+		}
+	}
+	if want := []string{"10.1.0.0/16 (a.txt) and 10.0.0.0/8 (b.txt)"}; !slices.Equal(conflicts, want) {
+		t.Errorf("conflicts = %v, want %v", conflicts, want)
+	}
+}
+
+func TestNewMegapoolFromSources_Error(t *testing.T) {
+	_, _, err := NewMegapoolFromSources(map[string]string{"a.txt": "1.1.1.1", "b.txt": "2.2.2"})
+	var pe *ParseError
+	if !errors.As(err, &pe) || !strings.HasPrefix(err.Error(), "source b.txt: ") {
+		t.Errorf("NewMegapoolFromSources() error = %v, want a *ParseError for b.txt", err)
+	}
+}
+
+func TestNewMegapoolLines(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{"empty", "", "", false},
+		{"one entry per line", "1.1.1.1\n1.1.2.0/24\n\n1.1.3.1-1.1.3.9\n", "1.1.1.1,1.1.2.0/24,1.1.3.1-1.1.3.9", false},
+		{"lines are trimmed", "  1.1.1.1 \t\r\n\t2.2.2.2\r\n", "1.1.1.1,2.2.2.2", false},
+		{"commas are not separators", "1.1.1.1,2.2.2.2", "", true},
+		{"semicolons are not separators", "1.1.1.1\n2.2.2.2;3.3.3.3", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewMegapoolLines(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewMegapoolLines() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got.String() != tt.want {
+				t.Errorf("NewMegapoolLines() = %v, want %v", got.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestNewMegapoolLines_ParseError(t *testing.T) {
+	input := "1.1.1.1\n 2.2.2.2, 3.3.3.3\n4.4.4.4"
+	_, err := NewMegapoolLines(input)
+	var pe *ParseError
+	if !errors.As(err, &pe) || pe.Value != "2.2.2.2, 3.3.3.3" || pe.Offset != 9 {
+		t.Errorf("NewMegapoolLines() error = %#v, want a *ParseError for the second line at 9", err)
+	}
+}
+
+func TestNewMegapool_ParseError(t *testing.T) {
+	tests := []struct {
+		name       string
+		input      string
+		wantValue  string
+		wantOffset int
+	}{
+		{"first", "1.1.1,2.2.2.2", "1.1.1", 0},
+		{"middle", "1.1.1.1,2.2.2.0/24;3.3.3.3-3.3.3.9, 4.4.4.400 ,5.5.5.5", "4.4.4.400", 36},
+		{"last", "1.1.1.1\n2.2.2", "2.2.2", 8},
+		{"leading spaces and separators", "  \n,,1.1.1.1,,\t2.2.2", "2.2.2", 15},
+		{"tagged", "1.1.1.1#a,2.2.2#b", "2.2.2#b", 10},
+		{"v6", "2001:db8::1,2001:db8::/129", "2001:db8::/129", 12},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewMegapool(tt.input)
+			var pe *ParseError
+			if !errors.As(err, &pe) {
+				t.Fatalf("NewMegapool() error = %v, want a *ParseError", err)
+			}
+			if pe.Value != tt.wantValue || pe.Offset != tt.wantOffset {
+				t.Errorf("NewMegapool() error at %q, %v, want %q, %v", pe.Value, pe.Offset, tt.wantValue, tt.wantOffset)
+			}
+			if got := tt.input[pe.Offset : pe.Offset+len(pe.Value)]; got != pe.Value {
+				t.Errorf("NewMegapool() error offset points at %q, want %q", got, pe.Value)
+			}
+		})
+	}
+}
+
+func TestParseItemsParallel_ParseError(t *testing.T) {
+	all := splitItems(largeInput(100) + "1.1.1")
+	for _, workers := range []int{1, 3, 8} {
+		_, err := parseItemsParallel(all, parseConfig{}, workers)
+		var pe *ParseError
+		if !errors.As(err, &pe) || pe.index != len(all)-1 {
+			t.Errorf("parseItemsParallel() error = %v, want a *ParseError at index %v", err, len(all)-1)
+		}
+	}
+}
+
+func TestNewMegapool_Brackets(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{"v6 URL host", "[2001:db8::1]", "2001:db8::1", false},
+		{"v6 prefix", "[2001:db8::/32]", "2001:db8::/32", false},
+		{"v6 range", "[2001:db8::1-2001:db8::5]", "2001:db8::1-2001:db8::5", false},
+		{"v4", "[1.1.1.1]", "1.1.1.1", false},
+		{"among other entries", "1.1.1.1, [2001:db8::1] ,2.2.2.2", "1.1.1.1,2.2.2.2,2001:db8::1", false},
+		{"tagged", "[2001:db8::1]#web", "2001:db8::1", false},
+		{"unbalanced opening", "[2001:db8::1", "", true},
+		{"unbalanced closing", "2001:db8::1]", "", true},
+		{"nested", "[[2001:db8::1]]", "", true},
+		{"empty", "[]", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewMegapool(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewMegapool() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got.String() != tt.want {
+				t.Errorf("NewMegapool() = %v, want %v", got.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestNewMegapool_TrailingDot(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{"ip", "1.1.1.1.", "1.1.1.1", false},
+		{"among other entries", "1.1.1.1., 2.2.2.2 ,3.3.3.3.", "1.1.1.1,2.2.2.2,3.3.3.3", false},
+		{"cidr", "1.1.1.0/24.", "1.1.1.0/24", false},
+		{"range", "1.1.1.1-1.1.1.5.", "1.1.1.1-1.1.1.5", false},
+		{"ipv6", "2001:db8::1.", "2001:db8::1", false},
+		{"quoted", `"1.1.1.1."`, "1.1.1.1", false},
+		{"tagged", "1.1.1.1.#web", "1.1.1.1", false},
+		{"double dot inside", "1.1.1..1", "", true},
+		{"two trailing dots", "1.1.1.1..", "", true},
+		{"leading dot", ".1.1.1.1", "", true},
+		{"only a dot", ".", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewMegapool(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewMegapool() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got.String() != tt.want {
+				t.Errorf("NewMegapool() = %v, want %v", got.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestNewMegapool_Quotes(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{"double-quoted ip", `"1.1.1.1"`, "1.1.1.1", false},
+		{"single-quoted ip", `'1.1.1.1'`, "1.1.1.1", false},
+		{"quoted cidr", `"1.1.1.0/24"`, "1.1.1.0/24", false},
+		{"quoted range", `'1.1.1.1-1.1.1.5'`, "1.1.1.1-1.1.1.5", false},
+		{"quoted v6 URL host", `"[2001:db8::1]"`, "2001:db8::1", false},
+		{"JSON array elements", `"1.1.1.1", "2.2.2.0/24" ,'3.3.3.3'`, "1.1.1.1,3.3.3.3,2.2.2.0/24", false},
+		{"tagged", `"1.1.1.1"#web`, "1.1.1.1", false},
+		{"mismatched quotes", `"1.1.1.1'`, "", true},
+		{"missing closing quote", `"1.1.1.1`, "", true},
+		{"missing opening quote", `1.1.1.1"`, "", true},
+		{"lone quote", `"`, "", true},
+		{"nested quotes", `"'1.1.1.1'"`, "", true},
+		{"empty quotes", `""`, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewMegapool(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewMegapool() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got.String() != tt.want {
+				t.Errorf("NewMegapool() = %v, want %v", got.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestMegapool_Dilate(t *testing.T) {
+	tests := []struct {
+		name string
+		main string
+		bits int
+		want string
+	}{
+		{"empty", "", 16, ""},
+		{"/24 to /16", "10.1.1.0/24", 16, "10.1.0.0/16"},
+		{"/24s merging into one /16", "10.1.1.0/24,10.1.200.0/24,10.1.5.7", 16, "10.1.0.0/16"},
+		{"adjacent /16s merge", "10.0.1.0/24,10.1.1.0/24", 16, "10.0.0.0/15"},
+		{"ip to its /31 pair", "1.1.1.4,1.1.1.9", 31, "1.1.1.4/31,1.1.1.8/31"},
+		{"range to its blocks", "1.1.1.10-1.1.1.20", 28, "1.1.1.0/27"},
+		{"wider entries kept", "10.0.0.0/8,11.1.1.1", 16, "10.0.0.0/8,11.1.0.0/16"},
+		{"both families", "1.1.1.1,2001:db8::1", 24, "1.1.1.0/24,2001:d00::/24"},
+		{"v4 kept for v6 length", "1.1.1.1,2001:db8::1", 64, "1.1.1.1,2001:db8::/64"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			got := m.Dilate(tt.bits)
+			if got.String() != tt.want {
+				t.Errorf("Megapool.Dilate() = %v, want %v", got.String(), tt.want)
+			}
+			if m.Relation(got) != RelContainedBy && m.Relation(got) != RelEqual {
+				t.Errorf("Megapool.Dilate() = %v does not contain %v", got.String(), m.String())
+			}
+		})
+	}
+}
+
+func TestMegapool_QuantizeToPow2(t *testing.T) {
+	tests := []struct {
+		name     string
+		main     string
+		want     string
+		wantSize int64
+	}{
+		{"empty", "", "", 0},
+		{"100 addresses to a /25", "1.1.1.0-1.1.1.99", "1.1.1.0/25", 128},
+		{"unaligned 100 addresses", "1.1.1.10-1.1.1.109", "1.1.1.0/25", 128},
+		{"across a /25 boundary", "1.1.1.100-1.1.1.199", "1.1.1.0/24", 256},
+		{"ips and prefixes kept", "1.1.1.1,1.1.2.0/24", "1.1.1.1,1.1.2.0/24", 257},
+		{"merged", "1.1.1.0-1.1.1.99,1.1.1.128-1.1.1.200", "1.1.1.0/24", 256},
+		{"ipv6", "2001:db8::1-2001:db8::5", "2001:db8::/125", 8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			got := m.QuantizeToPow2()
+			if got.String() != tt.want {
+				t.Errorf("Megapool.QuantizeToPow2() = %v, want %v", got.String(), tt.want)
+			}
+			if size := got.Size(); size.Cmp(big.NewInt(tt.wantSize)) != 0 {
+				t.Errorf("Megapool.QuantizeToPow2().Size() = %v, want %v", size, tt.wantSize)
+			}
+		})
+	}
+}
+
+func TestMegapool_WithNetworkAddrs(t *testing.T) {
+	tests := []struct {
+		name string
+		main string
+		bits int
+		want string
+	}{
+		{"empty", "", 24, ""},
+		{"hosts of a /24", "1.1.1.10,1.1.1.20-1.1.1.30,1.1.1.64/26", 24, "1.1.1.0,1.1.1.10,1.1.1.255,1.1.1.64/26,1.1.1.20-1.1.1.30"},
+		{"network already present", "1.1.1.0,1.1.1.10", 24, "1.1.1.0,1.1.1.10,1.1.1.255"},
+		{"full block", "1.1.1.0/24", 24, "1.1.1.0/24"},
+		{"several blocks", "1.1.1.10,1.1.2.10", 24, "1.1.1.0,1.1.1.10,1.1.1.255,1.1.2.0,1.1.2.10,1.1.2.255"},
+		{"range over two blocks", "1.1.1.200-1.1.1.255,1.1.2.0-1.1.2.10", 24, "1.1.1.0,1.1.2.255,1.1.1.200-1.1.1.255,1.1.2.0-1.1.2.10"},
+		{"/30", "1.1.1.1", 30, "1.1.1.0,1.1.1.1,1.1.1.3"},
+		{"/32", "1.1.1.1", 32, "1.1.1.1"},
+		{"ipv6", "2001:db8::10", 120, "2001:db8::,2001:db8::10,2001:db8::ff"},
+		{"v4 left alone for v6 length", "1.1.1.1,2001:db8::1", 64, "1.1.1.1,2001:db8::,2001:db8::1,2001:db8::ffff:ffff:ffff:ffff"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			got := m.WithNetworkAddrs(tt.bits)
+			if got.String() != tt.want {
+				t.Errorf("Megapool.WithNetworkAddrs() = %v, want %v", got.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestMegapool_UsableHosts(t *testing.T) {
+	tests := []struct {
+		name     string
+		main     string
+		want     string
+		wantSize string
+	}{
+		{"empty", "", "", "0"},
+		{"/24 loses 2 addresses", "1.1.1.0/24", "1.1.1.1-1.1.1.254", "254"},
+		{"/30", "1.1.1.4/30", "1.1.1.5-1.1.1.6", "2"},
+		{"/31 kept whole", "1.1.1.0/31", "1.1.1.0/31", "2"},
+		{"/32 kept whole", "1.1.1.1/32", "1.1.1.1/32", "1"},
+		{"/23", "1.1.0.0/23", "1.1.0.1-1.1.0.255,1.1.1.0-1.1.1.254", "510"},
+		{"v6 kept whole", "2001:db8::/126", "2001:db8::/126", "4"},
+		{"IPs and ranges kept", "1.1.1.0,1.1.2.0-1.1.2.255,1.1.3.0/30", "1.1.1.0,1.1.2.0-1.1.2.255,1.1.3.1-1.1.3.2", "259"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			got := m.UsableHosts()
+			want, _ := NewMegapool(tt.want)
+			if !got.Equal(want) {
+				t.Errorf("Megapool.UsableHosts() = %v, want %v", got.String(), want.String())
+			}
+			if size := got.Size().String(); size != tt.wantSize {
+				t.Errorf("Megapool.UsableHosts() size = %v, want %v", size, tt.wantSize)
+			}
+		})
+	}
+}
+
+func TestMegapool_Buckets(t *testing.T) {
+	tests := []struct {
+		name string
+		main string
+		bits int
+		want map[string]string
+	}{
+		{"empty", "", 24, map[string]string{}},
+		{"range over three /24s", "1.1.0.200-1.1.0.255,1.1.1.0/24,1.1.2.0-1.1.2.10", 24, map[string]string{
+			"1.1.0.0/24": "1.1.0.200-1.1.0.255",
+			"1.1.1.0/24": "1.1.1.0/24",
+			"1.1.2.0/24": "1.1.2.0-1.1.2.10",
+		}},
+		{"several entries in a bucket", "1.1.1.1,1.1.1.5,1.1.1.64/26,1.1.2.1", 24, map[string]string{
+			"1.1.1.0/24": "1.1.1.1,1.1.1.5,1.1.1.64/26",
+			"1.1.2.0/24": "1.1.2.1",
+		}},
+		{"prefix larger than the buckets", "1.1.0.0/23", 24, map[string]string{
+			"1.1.0.0/24": "1.1.0.0/24",
+			"1.1.1.0/24": "1.1.1.0/24",
+		}},
+		{"/16 buckets", "1.1.1.1,1.2.0.0/24", 16, map[string]string{
+			"1.1.0.0/16": "1.1.1.1",
+			"1.2.0.0/16": "1.2.0.0/24",
+		}},
+		{"dual-stack", "1.1.1.1,2001:db8::1", 24, map[string]string{
+			"1.1.1.0/24":    "1.1.1.1",
+			"2001:d00::/24": "2001:db8::1",
+		}},
+		{"v4 left out", "1.1.1.1,2001:db8::1", 64, map[string]string{
+			"2001:db8::/64": "2001:db8::1",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			got := map[string]string{}
+			for block, pool := range m.Buckets(tt.bits) {
+				got[block.String()] = pool.String()
+			}
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("Megapool.Buckets() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMegapool_LogValue(t *testing.T) {
+	tests := []struct {
+		name string
+		main string
+		want string
+	}{
+		{"empty", "", `level=INFO msg=loaded pool.ips=0 pool.cidrs=0 pool.ranges=0 pool.size=0 pool.sample=""`},
+		{"sample", "1.1.1.1,1.1.2.0/24,1.1.3.1-1.1.3.10", "level=INFO msg=loaded pool.ips=1 pool.cidrs=1 pool.ranges=1 pool.size=267 pool.sample=1.1.1.1,1.1.2.0/24,1.1.3.1-1.1.3.10"},
+		{"truncated sample", "1.1.1.1,1.1.1.2,1.1.1.3,1.1.2.0/24,1.1.3.0/24,1.1.4.0/24,1.1.5.1-1.1.5.10", "level=INFO msg=loaded pool.ips=3 pool.cidrs=3 pool.ranges=1 pool.size=781 pool.sample=1.1.1.1,1.1.1.2,1.1.1.3,1.1.2.0/24,1.1.3.0/24"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			var sb strings.Builder
+			logger := slog.New(slog.NewTextHandler(&sb, &slog.HandlerOptions{
+				ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+					if a.Key == slog.TimeKey && len(groups) == 0 {
+						return slog.Attr{}
+					}
+					return a
+				},
+			}))
+			logger.Info("loaded", "pool", m)
+			if got := strings.TrimSpace(sb.String()); got != tt.want {
+				t.Errorf("Megapool.LogValue() logged %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMegapool_AddrsStride(t *testing.T) {
+	every := func(from string, step, n int) []string {
+		var s []string
+		for i, a := 0, netip.MustParseAddr(from); i < n; i++ {
+			s = append(s, a.String())
+			a = addAddr(a, uint64(step))
+		}
+		return s
+	}
+	tests := []struct {
+		name string
+		main string
+		step int
+		want []string
+	}{
+		{"empty", "", 1, nil},
+		{"step 1 over a /24", "1.1.1.0/24", 1, every("1.1.1.0", 1, 256)},
+		{"step 10 over a /24", "1.1.1.0/24", 10, every("1.1.1.0", 10, 26)},
+		{"stride carries across ranges", "1.1.1.0-1.1.1.4,1.1.1.10-1.1.1.14", 3, []string{"1.1.1.0", "1.1.1.3", "1.1.1.11", "1.1.1.14"}},
+		{"ranges shorter than the stride", "1.1.1.0,1.1.1.5,1.1.1.9,1.1.1.20,1.1.1.30", 3, []string{"1.1.1.0", "1.1.1.20"}},
+		{"overlaps counted once", "1.1.1.0/30,1.1.1.2-1.1.1.5", 2, []string{"1.1.1.0", "1.1.1.2", "1.1.1.4"}},
+		{"top of the v4 space", "255.255.255.250-255.255.255.255", 4, []string{"255.255.255.250", "255.255.255.254"}},
+		{"top of the v6 space", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:fff0/124", 10, []string{"ffff:ffff:ffff:ffff:ffff:ffff:ffff:fff0", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:fffa"}},
+		{"zero step", "1.1.1.0/24", 0, nil},
+		{"negative step", "1.1.1.0/24", -1, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			var got []string
+			for a := range m.AddrsStride(tt.step) {
+				got = append(got, a.String())
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Megapool.AddrsStride() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMegapool_ShuffledAddrs(t *testing.T) {
+	m, _ := NewMegapool("1.1.1.0/24,1.1.1.5,1.1.3.1-1.1.3.10,2001:db8::/120,::ffff:1.1.4.4")
+	first := slices.Collect(m.ShuffledAddrs(42))
+	if again := slices.Collect(m.ShuffledAddrs(42)); !slices.Equal(first, again) {
+		t.Errorf("Megapool.ShuffledAddrs() = %v, then %v with the same seed", first, again)
+	}
+	if other := slices.Collect(m.ShuffledAddrs(43)); slices.Equal(first, other) {
+		t.Errorf("Megapool.ShuffledAddrs() = %v with two different seeds", first)
+	}
+	var want []netip.Addr
+	for _, r := range m.intervals() {
+		for a := r.From; ; a = a.Next() {
+			want = append(want, a)
+			if a == r.To {
+				break
+			}
+		}
+	}
+	if slices.Equal(first, want) {
+		t.Errorf("Megapool.ShuffledAddrs() = %v, want a shuffled order", first)
+	}
+	sorted := slices.Clone(first)
+	slices.SortFunc(sorted, netip.Addr.Compare)
+	if !slices.Equal(sorted, want) {
+		t.Errorf("Megapool.ShuffledAddrs() = %v, want every address of %v once", sorted, m.String())
+	}
+}
+
+func TestMegapool_ShuffledAddrs_Small(t *testing.T) {
+	tests := []struct {
+		name string
+		main string
+		want int
+	}{
+		{"empty", "", 0},
+		{"single address", "1.1.1.1", 1},
+		{"two addresses", "1.1.1.1,1.1.1.7", 2},
+		{"last address", "255.255.255.254/31", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, _ := NewMegapool(tt.main)
+			got := slices.Collect(m.ShuffledAddrs(1))
+			slices.SortFunc(got, netip.Addr.Compare)
+			if len(got) != tt.want || len(slices.Compact(got)) != tt.want {
+				t.Errorf("Megapool.ShuffledAddrs() = %v, want %v distinct addresses", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMegapool_ShuffledAddrs_Huge(t *testing.T) {
+	m, _ := NewMegapool("::/0")
+	seen := map[netip.Addr]bool{}
+	for a := range m.ShuffledAddrs(7) {
+		if seen[a] || !m.Contains(a) {
+			t.Fatalf("Megapool.ShuffledAddrs() yielded %v twice or outside the pool", a)
+		}
+		seen[a] = true
+		if len(seen) == 1000 {
+			break
+		}
 	}
-	return a
 }
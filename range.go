@@ -0,0 +1,144 @@
+package megapool
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/netip"
+)
+
+// Compare orders ranges by From, then by To. As with netip.Addr.Compare, IPv4
+// ranges sort before IPv6 ranges.
+func (r Range) Compare(other Range) int {
+	if c := r.From.Compare(other.From); c != 0 {
+		return c
+	}
+	return r.To.Compare(other.To)
+}
+
+// AsBigIntRange returns the endpoints of r as integers.
+func (r Range) AsBigIntRange() (*big.Int, *big.Int) {
+	return addrToInt(r.From), addrToInt(r.To)
+}
+
+// RangeFromBigInts is the reverse of AsBigIntRange. It fails when lo is
+// greater than hi or when either does not fit the requested family.
+func RangeFromBigInts(lo, hi *big.Int, is6 bool) (Range, error) {
+	if lo.Cmp(hi) > 0 {
+		return Range{}, fmt.Errorf("not an accepted range: %w: from=%v, to=%v", ErrReversedRange, lo, hi)
+	}
+	from, ok := intToAddr(lo, is6)
+	if !ok {
+		return Range{}, fmt.Errorf("not an ip address: value=%v", lo)
+	}
+	to, ok := intToAddr(hi, is6)
+	if !ok {
+		return Range{}, fmt.Errorf("not an ip address: value=%v", hi)
+	}
+	return Range{From: from, To: to}, nil
+}
+
+// SnapToCIDR returns the smallest prefix containing the whole range. The
+// prefix usually holds more addresses than the range itself.
+func (r Range) SnapToCIDR() netip.Prefix {
+	return netip.PrefixFrom(r.From, commonPrefixLen(r.From, r.To)).Masked()
+}
+
+// SplitByPrefixLen cuts r along the boundaries of /bits blocks, so that every
+// returned range lies within a single block. It returns nil when bits is not
+// a valid prefix length for the family of r.
+func (r Range) SplitByPrefixLen(bits int) []Range {
+	if bits < 0 || bits > r.From.BitLen() {
+		return nil
+	}
+	var rs []Range
+	for from := r.From; ; {
+		to := minAddr(lastAddr(netip.PrefixFrom(from, bits)), r.To)
+		rs = append(rs, Range{From: from, To: to})
+		if to == r.To {
+			return rs
+		}
+		from = to.Next()
+	}
+}
+
+// SplitAt cuts r in two just before addr, returning [From, addr-1] and
+// [addr, To]. It returns false when addr is not in r or is its From, which
+// would leave the first half empty.
+func (r Range) SplitAt(addr netip.Addr) (Range, Range, bool) {
+	addr = addr.Unmap()
+	if !addr.IsValid() || addr.Compare(r.From) <= 0 || addr.Compare(r.To) > 0 {
+		return Range{}, Range{}, false
+	}
+	return Range{From: r.From, To: addr.Prev()}, Range{From: addr, To: r.To}, true
+}
+
+// OverlapsPrefix reports whether r and p share at least one address. It
+// returns false when they are of different families.
+func (r Range) OverlapsPrefix(p netip.Prefix) bool {
+	pr, ok := r.familyRange(p)
+	return ok && r.From.Compare(pr.To) <= 0 && pr.From.Compare(r.To) <= 0
+}
+
+// ContainsPrefix reports whether every address of p is in r. It returns false
+// when they are of different families.
+func (r Range) ContainsPrefix(p netip.Prefix) bool {
+	pr, ok := r.familyRange(p)
+	return ok && r.From.Compare(pr.From) <= 0 && pr.To.Compare(r.To) <= 0
+}
+
+// familyRange returns p as a range, v4-mapped prefixes unmapped, or false if
+// p is not valid or not of the family of r.
+func (r Range) familyRange(p netip.Prefix) (Range, bool) {
+	if !p.IsValid() {
+		return Range{}, false
+	}
+	p = unmapPrefix(p)
+	if p.Addr().Is4() != r.From.Is4() || !r.From.IsValid() {
+		return Range{}, false
+	}
+	return prefixRange(p), true
+}
+
+// AsPrefixes decomposes r into the minimal list of CIDR blocks covering
+// exactly the same addresses, in ascending order. It returns nil when r is
+// not valid, i.e. when From is greater than To or they are of different
+// families.
+func (r Range) AsPrefixes() []netip.Prefix {
+	if !r.From.IsValid() || r.From.Is4() != r.To.Is4() || r.From.Compare(r.To) > 0 {
+		return nil
+	}
+	out, _ := appendRangePrefixes(nil, r, -1)
+	return out
+}
+
+type jsonRange struct {
+	From netip.Addr `json:"from"`
+	To   netip.Addr `json:"to"`
+}
+
+// MarshalJSON encodes r as {"from":"1.1.1.1","to":"1.1.1.10"}.
+func (r Range) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonRange(r))
+}
+
+// UnmarshalJSON decodes the form written by MarshalJSON. It fails when From
+// is greater than To or when they are of different families.
+func (r *Range) UnmarshalJSON(b []byte) error {
+	var j jsonRange
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	from, to := j.From.Unmap(), j.To.Unmap()
+	if !from.IsValid() || !to.IsValid() {
+		return fmt.Errorf("not an accepted range: value=%s", b)
+	}
+	if from.Is4() != to.Is4() {
+		return fmt.Errorf("not an accepted range: %w: value=%s", ErrMixedFamily, b)
+	}
+	if from.Compare(to) > 0 {
+		return fmt.Errorf("not an accepted range: %w: from=%v, to=%v", ErrReversedRange, from, to)
+	}
+	*r = Range{From: from, To: to}
+	return nil
+}
@@ -0,0 +1,327 @@
+package megapool
+
+import (
+	"encoding/json"
+	"math/big"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestRange_Compare(t *testing.T) {
+	tests := []struct {
+		name  string
+		r     Range
+		other Range
+		want  int
+	}{
+		{"equal", r("1.1.1.1-1.1.1.10"), r("1.1.1.1-1.1.1.10"), 0},
+		{"lower From", r("1.1.1.1-1.1.1.10"), r("1.1.1.2-1.1.1.10"), -1},
+		{"higher From", r("1.1.1.3-1.1.1.10"), r("1.1.1.2-1.1.1.10"), 1},
+		{"same From lower To", r("1.1.1.1-1.1.1.5"), r("1.1.1.1-1.1.1.10"), -1},
+		{"same From higher To", r("1.1.1.1-1.1.1.50"), r("1.1.1.1-1.1.1.10"), 1},
+		{"From wins over To", r("1.1.1.1-1.1.1.200"), r("1.1.1.2-1.1.1.3"), -1},
+		{"v4 before v6", r("255.255.255.1-255.255.255.2"), r("::1-::2"), -1},
+		{"v6 after v4", r("::1-::2"), r("1.1.1.1-1.1.1.2"), 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.r.Compare(tt.other); got != tt.want {
+				t.Errorf("Range.Compare() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRange_Compare_Sort(t *testing.T) {
+	want := []Range{
+		r("1.1.1.1-1.1.1.5"),
+		r("1.1.1.1-1.1.1.10"),
+		r("1.1.1.2-1.1.1.3"),
+		r("2.2.2.0-2.2.2.1"),
+		r("::1-::5"),
+		r("2001:db8::1-2001:db8::10"),
+	}
+	shuffled := [][]Range{
+		{want[5], want[2], want[0], want[4], want[1], want[3]},
+		{want[3], want[1], want[4], want[0], want[2], want[5]},
+		{want[1], want[0], want[3], want[2], want[5], want[4]},
+	}
+	for _, s := range shuffled {
+		slices.SortFunc(s, Range.Compare)
+		if !slices.Equal(s, want) {
+			t.Errorf("slices.SortFunc(Range.Compare) = %v, want %v", s, want)
+		}
+	}
+}
+
+func TestRange_AsBigIntRange(t *testing.T) {
+	tests := []struct {
+		name   string
+		r      Range
+		wantLo string
+		wantHi string
+	}{
+		{"v4", r("1.1.1.1-1.1.1.10"), "16843009", "16843018"},
+		{"v4 bounds", Range{From: a("0.0.0.0"), To: a("255.255.255.255")}, "0", "4294967295"},
+		{"v6", r("::1-::ff"), "1", "255"},
+		{"v6 bounds", Range{From: a("::"), To: a("ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff")}, "0", "340282366920938463463374607431768211455"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lo, hi := tt.r.AsBigIntRange()
+			if lo.String() != tt.wantLo || hi.String() != tt.wantHi {
+				t.Errorf("Range.AsBigIntRange() = %v, %v, want %v, %v", lo, hi, tt.wantLo, tt.wantHi)
+			}
+			got, err := RangeFromBigInts(lo, hi, tt.r.From.Is6())
+			if err != nil || got != tt.r {
+				t.Errorf("RangeFromBigInts() = %v, %v, want %v", got.String(), err, tt.r.String())
+			}
+		})
+	}
+}
+
+func TestRangeFromBigInts(t *testing.T) {
+	tests := []struct {
+		name    string
+		lo      *big.Int
+		hi      *big.Int
+		is6     bool
+		want    Range
+		wantErr bool
+	}{
+		{"v4", big.NewInt(16843009), big.NewInt(16843018), false, r("1.1.1.1-1.1.1.10"), false},
+		{"v6", big.NewInt(1), big.NewInt(255), true, r("::1-::ff"), false},
+		{"reversed", big.NewInt(10), big.NewInt(1), false, Range{}, true},
+		{"negative", big.NewInt(-1), big.NewInt(1), false, Range{}, true},
+		{"too large for v4", big.NewInt(1), new(big.Int).Lsh(big.NewInt(1), 32), false, Range{}, true},
+		{"too large for v6", big.NewInt(1), new(big.Int).Lsh(big.NewInt(1), 128), true, Range{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := RangeFromBigInts(tt.lo, tt.hi, tt.is6)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("RangeFromBigInts() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("RangeFromBigInts() = %v, want %v", got.String(), tt.want.String())
+			}
+		})
+	}
+}
+
+func TestRange_SnapToCIDR(t *testing.T) {
+	tests := []struct {
+		name string
+		r    Range
+		want netip.Prefix
+	}{
+		{"snaps to a /24", r("1.1.1.1-1.1.1.200"), p("1.1.1.0/24")},
+		{"snaps to a /28", r("1.1.1.1-1.1.1.10"), p("1.1.1.0/28")},
+		{"already aligned", r("1.1.1.0-1.1.1.127"), p("1.1.1.0/25")},
+		{"snaps to a /22", Range{From: a("1.1.0.5"), To: a("1.1.3.7")}, p("1.1.0.0/22")},
+		{"single address", Range{From: a("1.1.1.1"), To: a("1.1.1.1")}, p("1.1.1.1/32")},
+		{"v6", r("2001:db8::1-2001:db8::ff"), p("2001:db8::/120")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.r.SnapToCIDR(); got != tt.want {
+				t.Errorf("Range.SnapToCIDR() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func r(s string) Range {
+	r, err := parseRange(s)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+func TestRange_SplitByPrefixLen(t *testing.T) {
+	span := func(from, to string) Range {
+		return Range{From: netip.MustParseAddr(from), To: netip.MustParseAddr(to)}
+	}
+	tests := []struct {
+		name string
+		r    Range
+		bits int
+		want []Range
+	}{
+		{"three /24 blocks", span("1.1.0.5", "1.1.2.10"), 24, []Range{span("1.1.0.5", "1.1.0.255"), span("1.1.1.0", "1.1.1.255"), span("1.1.2.0", "1.1.2.10")}},
+		{"within one /24", r("1.1.1.1-1.1.1.10"), 24, []Range{r("1.1.1.1-1.1.1.10")}},
+		{"aligned /24 blocks", span("1.1.0.0", "1.1.1.255"), 24, []Range{span("1.1.0.0", "1.1.0.255"), span("1.1.1.0", "1.1.1.255")}},
+		{"ending on a boundary", span("1.1.0.128", "1.1.1.0"), 24, []Range{span("1.1.0.128", "1.1.0.255"), span("1.1.1.0", "1.1.1.0")}},
+		{"two /16 blocks", span("1.1.200.0", "1.2.0.7"), 16, []Range{span("1.1.200.0", "1.1.255.255"), span("1.2.0.0", "1.2.0.7")}},
+		{"aligned /16 block", span("1.1.0.0", "1.1.255.255"), 16, []Range{span("1.1.0.0", "1.1.255.255")}},
+		{"/32 blocks", r("1.1.1.1-1.1.1.3"), 32, []Range{span("1.1.1.1", "1.1.1.1"), span("1.1.1.2", "1.1.1.2"), span("1.1.1.3", "1.1.1.3")}},
+		{"up to the last address", span("255.255.254.200", "255.255.255.255"), 24, []Range{span("255.255.254.200", "255.255.254.255"), span("255.255.255.0", "255.255.255.255")}},
+		{"v6", span("2001:db8::ff00", "2001:db8::1:5"), 112, []Range{span("2001:db8::ff00", "2001:db8::ffff"), span("2001:db8::1:0", "2001:db8::1:5")}},
+		{"invalid length", r("1.1.1.1-1.1.1.3"), 33, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.r.SplitByPrefixLen(tt.bits); !slices.Equal(got, tt.want) {
+				t.Errorf("Range.SplitByPrefixLen() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRange_SplitAt(t *testing.T) {
+	span := func(from, to string) Range {
+		return Range{From: netip.MustParseAddr(from), To: netip.MustParseAddr(to)}
+	}
+	tests := []struct {
+		name      string
+		r         Range
+		addr      string
+		wantLo    Range
+		wantHi    Range
+		wantSplit bool
+	}{
+		{"middle", r("1.1.1.1-1.1.1.10"), "1.1.1.5", r("1.1.1.1-1.1.1.4"), r("1.1.1.5-1.1.1.10"), true},
+		{"second address", r("1.1.1.1-1.1.1.10"), "1.1.1.2", span("1.1.1.1", "1.1.1.1"), r("1.1.1.2-1.1.1.10"), true},
+		{"last address", r("1.1.1.1-1.1.1.10"), "1.1.1.10", r("1.1.1.1-1.1.1.9"), span("1.1.1.10", "1.1.1.10"), true},
+		{"across blocks", span("1.1.0.200", "1.1.1.10"), "1.1.1.0", span("1.1.0.200", "1.1.0.255"), r("1.1.1.0-1.1.1.10"), true},
+		{"v4-mapped", r("1.1.1.1-1.1.1.10"), "::ffff:1.1.1.5", r("1.1.1.1-1.1.1.4"), r("1.1.1.5-1.1.1.10"), true},
+		{"v6", r("2001:db8::1-2001:db8::ff"), "2001:db8::10", r("2001:db8::1-2001:db8::f"), r("2001:db8::10-2001:db8::ff"), true},
+		{"first address", r("1.1.1.1-1.1.1.10"), "1.1.1.1", Range{}, Range{}, false},
+		{"before", r("1.1.1.1-1.1.1.10"), "1.1.1.0", Range{}, Range{}, false},
+		{"after", r("1.1.1.1-1.1.1.10"), "1.1.1.11", Range{}, Range{}, false},
+		{"other family", r("1.1.1.1-1.1.1.10"), "2001:db8::5", Range{}, Range{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lo, hi, ok := tt.r.SplitAt(netip.MustParseAddr(tt.addr))
+			if lo != tt.wantLo || hi != tt.wantHi || ok != tt.wantSplit {
+				t.Errorf("Range.SplitAt() = %v, %v, %v, want %v, %v, %v", lo, hi, ok, tt.wantLo, tt.wantHi, tt.wantSplit)
+			}
+		})
+	}
+}
+
+func TestRange_OverlapsPrefix(t *testing.T) {
+	tests := []struct {
+		name         string
+		r            Range
+		p            string
+		wantOverlaps bool
+		wantContains bool
+	}{
+		{"/28 inside", r("1.1.1.0-1.1.1.100"), "1.1.1.16/28", true, true},
+		{"/28 at the start", r("1.1.1.0-1.1.1.100"), "1.1.1.0/28", true, true},
+		{"/28 across the end", r("1.1.1.0-1.1.1.100"), "1.1.1.96/28", true, false},
+		{"/28 across the start", r("1.1.1.20-1.1.1.100"), "1.1.1.16/28", true, false},
+		{"/28 disjoint", r("1.1.1.0-1.1.1.100"), "1.1.1.112/28", false, false},
+		{"/28 just after", r("1.1.1.0-1.1.1.15"), "1.1.1.16/28", false, false},
+		{"/24 around", r("1.1.1.10-1.1.1.20"), "1.1.1.0/24", true, false},
+		{"/24 exactly", r("1.1.1.0-1.1.1.255"), "1.1.1.0/24", true, true},
+		{"/24 disjoint", r("1.1.1.10-1.1.1.20"), "1.1.2.0/24", false, false},
+		{"unmasked", r("1.1.1.0-1.1.1.100"), "1.1.1.20/28", true, true},
+		{"v4-mapped", r("1.1.1.0-1.1.1.100"), "::ffff:1.1.1.16/124", true, true},
+		{"family mismatch", r("1.1.1.0-1.1.1.100"), "::/0", false, false},
+		{"v6", r("2001:db8::-2001:db8::ff"), "2001:db8::/120", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pfx := netip.MustParsePrefix(tt.p)
+			if got := tt.r.OverlapsPrefix(pfx); got != tt.wantOverlaps {
+				t.Errorf("Range.OverlapsPrefix() = %v, want %v", got, tt.wantOverlaps)
+			}
+			if got := tt.r.ContainsPrefix(pfx); got != tt.wantContains {
+				t.Errorf("Range.ContainsPrefix() = %v, want %v", got, tt.wantContains)
+			}
+		})
+	}
+	if (Range{}).OverlapsPrefix(netip.Prefix{}) || (Range{}).ContainsPrefix(netip.Prefix{}) {
+		t.Errorf("Range.OverlapsPrefix() = true for zero values, want false")
+	}
+}
+
+func TestRange_AsPrefixes(t *testing.T) {
+	span := func(from, to string) Range {
+		return Range{From: netip.MustParseAddr(from), To: netip.MustParseAddr(to)}
+	}
+	tests := []struct {
+		name string
+		r    Range
+		want []netip.Prefix
+	}{
+		{"single /24", r("1.1.1.0-1.1.1.255"), []netip.Prefix{p("1.1.1.0/24")}},
+		{"mixed lengths", r("1.1.1.1-1.1.1.6"), []netip.Prefix{p("1.1.1.1/32"), p("1.1.1.2/31"), p("1.1.1.4/31"), p("1.1.1.6/32")}},
+		{"single address", span("1.1.1.1", "1.1.1.1"), []netip.Prefix{p("1.1.1.1/32")}},
+		{"across blocks", span("1.1.0.255", "1.1.2.0"), []netip.Prefix{p("1.1.0.255/32"), p("1.1.1.0/24"), p("1.1.2.0/32")}},
+		{"whole v4 space", span("0.0.0.0", "255.255.255.255"), []netip.Prefix{p("0.0.0.0/0")}},
+		{"v6", r("2001:db8::-2001:db8::ff"), []netip.Prefix{p("2001:db8::/120")}},
+		{"v6 mixed lengths", r("2001:db8::1-2001:db8::4"), []netip.Prefix{p("2001:db8::1/128"), p("2001:db8::2/127"), p("2001:db8::4/128")}},
+		{"reversed", span("1.1.1.6", "1.1.1.1"), nil},
+		{"mixed family", span("1.1.1.1", "2001:db8::1"), nil},
+		{"zero value", Range{}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.r.AsPrefixes(); !slices.Equal(got, tt.want) {
+				t.Errorf("Range.AsPrefixes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRange_JSON(t *testing.T) {
+	tests := []struct {
+		name string
+		r    Range
+		want string
+	}{
+		{"v4", r("1.1.1.1-1.1.1.10"), `{"from":"1.1.1.1","to":"1.1.1.10"}`},
+		{"v6", r("2001:db8::1-2001:db8::ff"), `{"from":"2001:db8::1","to":"2001:db8::ff"}`},
+		{"across blocks", Range{From: netip.MustParseAddr("1.1.0.5"), To: netip.MustParseAddr("1.1.3.7")}, `{"from":"1.1.0.5","to":"1.1.3.7"}`},
+		{"single address", Range{From: netip.MustParseAddr("1.1.1.1"), To: netip.MustParseAddr("1.1.1.1")}, `{"from":"1.1.1.1","to":"1.1.1.1"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := json.Marshal(tt.r)
+			if err != nil || string(b) != tt.want {
+				t.Fatalf("Range.MarshalJSON() = %s, %v, want %v", b, err, tt.want)
+			}
+			var got Range
+			if err := json.Unmarshal(b, &got); err != nil || got != tt.r {
+				t.Errorf("Range.UnmarshalJSON() = %v, %v, want %v", got.String(), err, tt.r.String())
+			}
+		})
+	}
+}
+
+func TestRange_UnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    Range
+		wantErr bool
+	}{
+		{"in a slice", `[{"from":"1.1.1.1","to":"1.1.1.10"}]`, r("1.1.1.1-1.1.1.10"), false},
+		{"v4-mapped", `[{"from":"::ffff:1.1.1.1","to":"1.1.1.10"}]`, r("1.1.1.1-1.1.1.10"), false},
+		{"reversed", `[{"from":"1.1.1.10","to":"1.1.1.1"}]`, Range{}, true},
+		{"mixed families", `[{"from":"1.1.1.1","to":"::1"}]`, Range{}, true},
+		{"missing to", `[{"from":"1.1.1.1"}]`, Range{}, true},
+		{"not an address", `[{"from":"1.1.1","to":"1.1.1.10"}]`, Range{}, true},
+		{"not an object", `["1.1.1.1-1.1.1.10"]`, Range{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []Range
+			err := json.Unmarshal([]byte(tt.input), &got)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Range.UnmarshalJSON() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && (len(got) != 1 || got[0] != tt.want) {
+				t.Errorf("Range.UnmarshalJSON() = %v, want %v", got, tt.want.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,34 @@
+package megapool
+
+import "strings"
+
+// Rules holds allow and deny entries parsed from a single list.
+type Rules struct {
+	Allow Megapool
+	Deny  Megapool
+}
+
+// NewRules parses input like NewMegapool, except that entries prefixed with
+// "!" such as !10.1.0.0/16 end up in Deny rather than Allow.
+func NewRules(input string) (Rules, error) {
+	var r Rules
+	items := strings.TrimSpace(input)
+	if len(items) == 0 {
+		return Rules{}, nil
+	}
+	for _, v := range splitItems(items) {
+		pool := &r.Allow
+		if rest, ok := strings.CutPrefix(strings.TrimSpace(v), "!"); ok {
+			v, pool = rest, &r.Deny
+		}
+		if err := pool.parseItem(v, parseConfig{}); err != nil {
+			return Rules{}, err
+		}
+	}
+	return r, nil
+}
+
+// Effective returns the allowed addresses that are not denied.
+func (r *Rules) Effective() Megapool {
+	return r.Allow.Subtract(r.Deny)
+}
@@ -0,0 +1,57 @@
+package megapool
+
+import "testing"
+
+func TestNewRules(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		wantAllow string
+		wantDeny  string
+		wantErr   bool
+	}{
+		{"empty", "", "", "", false},
+		{"only allow", "10.0.0.0/8,1.1.1.1", "10.0.0.0/8,1.1.1.1", "", false},
+		{"allow and deny", "10.0.0.0/8\n!10.1.0.0/16\n 	! 10.2.2.2\n1.1.1.1-1.1.1.10", "10.0.0.0/8,1.1.1.1-1.1.1.10", "10.1.0.0/16,10.2.2.2", false},
+		{"only deny", "!10.1.0.0/16", "", "10.1.0.0/16", false},
+		{"bad deny", "10.0.0.0/8,!10.1.0.0/66", "", "", true},
+		{"double negation", "!!10.1.0.0/16", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewRules(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewRules() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			wantAllow, _ := NewMegapool(tt.wantAllow)
+			wantDeny, _ := NewMegapool(tt.wantDeny)
+			if !got.Allow.Equal(wantAllow) || !got.Deny.Equal(wantDeny) {
+				t.Errorf("NewRules() = %v, %v, want %v, %v", got.Allow.String(), got.Deny.String(), wantAllow.String(), wantDeny.String())
+			}
+		})
+	}
+}
+
+func TestRules_Effective(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"empty", "", ""},
+		{"deny carves a hole", "10.0.0.0/14,!10.1.0.0/16", "10.0.0.0/16,10.2.0.0/15"},
+		{"deny carves a single address", "1.1.1.0/24,!1.1.1.5", "1.1.1.0-1.1.1.4,1.1.1.6-1.1.1.255"},
+		{"deny outside allow is a no-op", "10.0.0.0/8,!192.168.0.0/16", "10.0.0.0/8"},
+		{"deny everything", "10.1.0.0/16,!10.0.0.0/8", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := NewRules(tt.input)
+			want, _ := NewMegapool(tt.want)
+			if got := r.Effective(); !got.Equal(want) {
+				t.Errorf("Rules.Effective() = %v, want %v", got.String(), want.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package megapool
+
+import (
+	"net/netip"
+	"sync"
+)
+
+// SyncMegapool is a Megapool safe for concurrent use, e.g. an allow-list
+// updated live while requests are checked against it. Reads share a lock,
+// Add and Remove take it exclusively.
+type SyncMegapool struct {
+	mu sync.RWMutex
+	m  Megapool
+}
+
+// NewSyncMegapool returns a SyncMegapool holding a copy of the entries of m.
+func NewSyncMegapool(m Megapool) *SyncMegapool {
+	return &SyncMegapool{m: m.clone()}
+}
+
+// Contains is Megapool.Contains.
+func (s *SyncMegapool) Contains(addr netip.Addr) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.m.Contains(addr)
+}
+
+// Overlaps is Megapool.Overlaps.
+func (s *SyncMegapool) Overlaps(others ...Megapool) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.m.Overlaps(others...)
+}
+
+// Add is Megapool.Add.
+func (s *SyncMegapool) Add(items ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.m.Add(items...)
+}
+
+// Remove is Megapool.Remove.
+func (s *SyncMegapool) Remove(items ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.m.Remove(items...)
+}
+
+// Snapshot returns a copy of the pool that later changes do not affect.
+func (s *SyncMegapool) Snapshot() Megapool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.m.clone()
+}
@@ -0,0 +1,74 @@
+package megapool
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+	"testing"
+)
+
+func TestSyncMegapool(t *testing.T) {
+	m, _ := NewMegapool("1.1.1.0/24")
+	s := NewSyncMegapool(m)
+	m.IPPool = append(m.IPPool, a("2.2.2.2"))
+	if s.Contains(a("2.2.2.2")) {
+		t.Errorf("SyncMegapool.Contains() = true for an address added to the source pool after the copy")
+	}
+	if err := s.Add("2.2.2.2"); err != nil {
+		t.Fatalf("SyncMegapool.Add() error = %v", err)
+	}
+	if !s.Contains(a("2.2.2.2")) || !s.Contains(a("1.1.1.1")) {
+		t.Errorf("SyncMegapool.Contains() = false after Add")
+	}
+	if err := s.Remove("1.1.1.1"); err != nil {
+		t.Fatalf("SyncMegapool.Remove() error = %v", err)
+	}
+	other, _ := NewMegapool("1.1.1.1")
+	if s.Overlaps(other) {
+		t.Errorf("SyncMegapool.Overlaps() = true after Remove")
+	}
+	if err := s.Add("3.3.3"); err == nil {
+		t.Errorf("SyncMegapool.Add() error = nil, want an error")
+	}
+	snap := s.Snapshot()
+	if got, want := snap.String(), "1.1.1.0,2.2.2.2,1.1.1.2-1.1.1.255"; got != want {
+		t.Errorf("SyncMegapool.Snapshot() = %v, want %v", got, want)
+	}
+	_ = s.Add("4.4.4.4")
+	if snap.Contains(a("4.4.4.4")) {
+		t.Errorf("SyncMegapool.Snapshot() changed after Add")
+	}
+}
+
+// TestSyncMegapool_Concurrent is meant to be run with -race.
+func TestSyncMegapool_Concurrent(t *testing.T) {
+	s := NewSyncMegapool(Megapool{})
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				if err := s.Add(fmt.Sprintf("10.%d.%d.1", w, i)); err != nil {
+					t.Errorf("SyncMegapool.Add() error = %v", err)
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				s.Contains(a(fmt.Sprintf("10.%d.%d.1", w, i)))
+				s.Overlaps(Megapool{IPPool: []netip.Addr{a("10.0.0.1")}})
+			}
+		}()
+	}
+	wg.Wait()
+	for w := 0; w < 4; w++ {
+		for i := 0; i < 200; i++ {
+			if addr := a(fmt.Sprintf("10.%d.%d.1", w, i)); !s.Contains(addr) {
+				t.Fatalf("SyncMegapool.Contains(%v) = false after Add", addr)
+			}
+		}
+	}
+}
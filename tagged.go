@@ -0,0 +1,73 @@
+package megapool
+
+import "strings"
+
+// TaggedMegapool is a Megapool that keeps the label every entry was parsed
+// with, e.g. "office" for 1.1.1.0/24#office. The labels are only known to the
+// methods of TaggedMegapool itself, pools returned by the embedded Megapool
+// such as Normalize, Union, Intersection, Subtract or ClampTo carry none.
+type TaggedMegapool struct {
+	Megapool
+
+	// tags maps the string form of an entry to its label.
+	tags map[string]string
+}
+
+// NewTaggedMegapool behaves like NewMegapool but keeps the labels of tagged
+// entries.
+func NewTaggedMegapool(input string, opts ...Option) (TaggedMegapool, error) {
+	cfg := parseConfig{tags: map[string]string{}}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	m, err := parse(input, cfg)
+	if err != nil {
+		return TaggedMegapool{}, err
+	}
+	return TaggedMegapool{Megapool: m, tags: cfg.tags}, nil
+}
+
+// Tag returns the label entry was tagged with on parse, if any.
+func (t *TaggedMegapool) Tag(entry string) (string, bool) {
+	var e Megapool
+	if err := e.parseItem(entry, parseConfig{}); err != nil {
+		return "", false
+	}
+	tag, ok := t.tags[e.AsSlice()[0]]
+	return tag, ok
+}
+
+// AsSlice is Megapool.AsSlice with every tagged entry followed by #label.
+func (t *TaggedMegapool) AsSlice() []string {
+	s := t.Megapool.AsSlice()
+	for i, entry := range s {
+		if tag, ok := t.tags[entry]; ok {
+			s[i] = entry + "#" + tag
+		}
+	}
+	return s
+}
+
+// String is Megapool.String with every tagged entry followed by #label, so
+// that it parses back with NewTaggedMegapool.
+func (t *TaggedMegapool) String() string {
+	return strings.Join(t.AsSlice(), ",")
+}
+
+// SplitByFamily is Megapool.SplitByFamily keeping the labels, each one in the
+// pool holding its entry.
+func (t *TaggedMegapool) SplitByFamily() (v4 TaggedMegapool, v6 TaggedMegapool) {
+	p4, p6 := t.Megapool.SplitByFamily()
+	return t.withTagsOf(p4), t.withTagsOf(p6)
+}
+
+// withTagsOf wraps m, whose entries are taken from t, with their labels.
+func (t *TaggedMegapool) withTagsOf(m Megapool) TaggedMegapool {
+	tagged := TaggedMegapool{Megapool: m, tags: map[string]string{}}
+	for _, entry := range m.AsSlice() {
+		if tag, ok := t.tags[entry]; ok {
+			tagged.tags[entry] = tag
+		}
+	}
+	return tagged
+}
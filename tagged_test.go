@@ -0,0 +1,121 @@
+package megapool
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestTaggedMegapool_Tag(t *testing.T) {
+	m, err := NewTaggedMegapool("1.1.1.0/24#office, 2.2.2.2 # vpn, 3.3.3.3, 4.4.4.1-4.4.4.9#lab, ::ffff:5.5.5.5#mapped, 6.6.6.6#")
+	if err != nil {
+		t.Fatalf("NewTaggedMegapool() error = %v", err)
+	}
+	tests := []struct {
+		name   string
+		entry  string
+		want   string
+		wantOk bool
+	}{
+		{"tagged CIDR", "1.1.1.0/24", "office", true},
+		{"tagged IP with spaces", "2.2.2.2", "vpn", true},
+		{"tagged range", "4.4.4.1-4.4.4.9", "lab", true},
+		{"tagged v4-mapped IP", "5.5.5.5", "mapped", true},
+		{"lookup by v4-mapped form", "::ffff:5.5.5.5", "mapped", true},
+		{"untagged", "3.3.3.3", "", false},
+		{"empty tag", "6.6.6.6", "", false},
+		{"not in pool", "7.7.7.7", "", false},
+		{"not an entry", "7.7.7", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := m.Tag(tt.entry)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("TaggedMegapool.Tag() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+
+	want := []string{"2.2.2.2#vpn", "3.3.3.3", "5.5.5.5#mapped", "6.6.6.6", "1.1.1.0/24#office", "4.4.4.1-4.4.4.9#lab"}
+	if got := m.AsSlice(); !slices.Equal(got, want) {
+		t.Errorf("TaggedMegapool.AsSlice() = %v, want %v", got, want)
+	}
+	roundTrip, err := NewTaggedMegapool(m.String())
+	if err != nil {
+		t.Fatalf("NewTaggedMegapool() error = %v", err)
+	}
+	if got := roundTrip.String(); got != m.String() {
+		t.Errorf("TaggedMegapool.String() = %v, want %v", got, m.String())
+	}
+	if !roundTrip.Equal(m.Megapool) {
+		t.Errorf("Megapool.Equal() = false after round-trip of %v", m.String())
+	}
+}
+
+func TestNewTaggedMegapool(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		opts      []Option
+		want      string
+		wantPlain string
+		wantErr   bool
+	}{
+		{"empty", "", nil, "", "", false},
+		{"untagged", "1.1.1.1,1.1.1.0/24", nil, "1.1.1.1,1.1.1.0/24", "1.1.1.1,1.1.1.0/24", false},
+		{"last label wins", "1.1.1.1#a,1.1.1.1#b", nil, "1.1.1.1#b,1.1.1.1#b", "1.1.1.1,1.1.1.1", false},
+		{"degenerate range", "1.1.1.5-1.1.1.5#gw", []Option{WithSingleAddressRanges()}, "1.1.1.5#gw", "1.1.1.5", false},
+		{"exclusive range", "1.1.1.0-1.1.1.10#lab", []Option{WithExclusiveRanges()}, "1.1.1.0-1.1.1.9#lab", "1.1.1.0-1.1.1.9", false},
+		{"wildcard", "1.1.1.*#office,2.2.2.2", []Option{WithWildcards()}, "2.2.2.2,1.1.1.0/24#office", "2.2.2.2,1.1.1.0/24", false},
+		{"error", "1.1.1.1#a,1.1.1#b", nil, "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewTaggedMegapool(tt.input, tt.opts...)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewTaggedMegapool() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got.String() != tt.want {
+				t.Errorf("NewTaggedMegapool() = %v, want %v", got.String(), tt.want)
+			}
+			if got.Megapool.String() != tt.wantPlain {
+				t.Errorf("Megapool.String() = %v, want %v", got.Megapool.String(), tt.wantPlain)
+			}
+			plain, _ := NewMegapool(tt.input, tt.opts...)
+			if !plain.Equal(got.Megapool) {
+				t.Errorf("NewMegapool() = %v, want %v", plain.String(), got.Megapool.String())
+			}
+		})
+	}
+}
+
+func TestTaggedMegapool_SplitByFamily(t *testing.T) {
+	m, _ := NewTaggedMegapool("1.1.1.1#a,2001:db8::1#b,1.1.1.0/24,2001:db8::/32#c,::ffff:2.2.2.2#d,::1-::5#e")
+	v4, v6 := m.SplitByFamily()
+	if got, want := v4.String(), "1.1.1.1#a,2.2.2.2#d,1.1.1.0/24"; got != want {
+		t.Errorf("TaggedMegapool.SplitByFamily() v4 = %v, want %v", got, want)
+	}
+	if got, want := v6.String(), "2001:db8::1#b,2001:db8::/32#c,::1-::5#e"; got != want {
+		t.Errorf("TaggedMegapool.SplitByFamily() v6 = %v, want %v", got, want)
+	}
+	for _, entry := range []string{"2001:db8::1", "2001:db8::/32", "::1-::5"} {
+		if tag, ok := v4.Tag(entry); ok {
+			t.Errorf("TaggedMegapool.Tag(%v) = %v on the v4 pool, want none", entry, tag)
+		}
+	}
+	for _, entry := range []string{"1.1.1.1", "2.2.2.2"} {
+		if tag, ok := v6.Tag(entry); ok {
+			t.Errorf("TaggedMegapool.Tag(%v) = %v on the v6 pool, want none", entry, tag)
+		}
+	}
+}
+
+func TestNewTaggedMegapool_CommentPrefixes(t *testing.T) {
+	m, err := NewTaggedMegapool("# offices\n1.1.1.0/24#office\n; vpn\n2.2.2.2 # vpn", WithCommentPrefixes())
+	if err != nil {
+		t.Fatalf("NewTaggedMegapool() error = %v", err)
+	}
+	if got, want := m.String(), "2.2.2.2#vpn,1.1.1.0/24#office"; got != want {
+		t.Errorf("NewTaggedMegapool() = %v, want %v", got, want)
+	}
+}